@@ -5,6 +5,8 @@
 // + 无序的可以前加标记X以标记
 // + 文件大小和纪录条数的限制，任意一个满足都OK
 // + Log文件自增后缀号码
+// + session的log系统，可写入单独的文件
+// + error系统
 //
 // TODO:
 //
@@ -14,8 +16,6 @@
 // - 写管道的时候如果已关闭是什么报错？
 // - 命令管道只做命令传递
 // - 如何量化性能指标？
-// - error系统
-// - session的log系统
 // - 自起一个服务，可以提供运行时修改参数
 // - json结构的部分更新
 // - json解析的性能指标
@@ -28,14 +28,17 @@ package ceLogger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math"
 	"os"
+	"os/signal"
 	"path"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -47,30 +50,71 @@ func init() {
 // CeLogger
 // ----------
 
-type logEntry struct {
-	i   uint
-	buf []byte
+// LogEntry is one log entry passed to every Sink
+type LogEntry struct {
+	Index   uint         // auto increment seq index, 0 if not logged
+	Time    time.Time    // time of log call
+	Level   string       // entry config name, e.g. "Info", "" for func enter/exit
+	Tag     string       // user tag, e.g. "HTTP"
+	Content string       // log content
+	Fields  []Field      // key/value fields
+	Stack   []StackFrame // stack trace of log call, nil if not captured, see EntryConfig.IsStack
+	File    string       // filename in code, e.g. "abc.go"
+	Line    int          // line number in code
+	Func    string       // func name in code, e.g. "main.test"
+
+	ec      *EntryConfig // nil for func enter/exit
+	session *Session     // session of entry, nil if not logged by session
+}
+
+// If write log entry to file, based on entry config
+func (e *LogEntry) isWriteFile() bool {
+	return e.ec == nil || e.ec.IsWriteFile
+}
+
+// If write log entry to console, based on entry config
+func (e *LogEntry) isWriteConsole() bool {
+	return e.ec == nil || e.ec.IsWriteConsole
 }
 
 type CeLogger struct {
 	*CeLoggerConfig
+	*ceLoggerState // shared with child loggers created by With()
+
+	tag        string   // tag prepended to user tag, set by WithTag()
+	fields     []Field  // fields prepended to every entry, set by With()
+	session    *Session // session of entries, set by StartSession()
+	callerSkip int      // extra frames skipped to find caller of log call, set by AddCallerSkip()
+}
+
+// Runtime state of logger
+type ceLoggerState struct {
+	// 64-bit aligned for atomic
+	seqIndex     uint64 // next auto increment seq index for all log entry, atomic
+	dropCount    uint64 // entry count dropped by OverflowPolicy
+	sessionCount uint64 // session count started by StartSession(), for session ID
 
 	IsEnable bool
 
-	mutex        sync.Mutex
-	seqIndex     uint // auto increment seq index for all log entry
-	isFirstEntry bool // init as true to indicate it is first log entry
-	entryIndex   uint // entry index in current log file
-	entryNum     uint // entry count in current log file
-	fileSize     uint // file size of current log file
-	writeCount   uint
-	readCount    uint
-	filename     string         // current log file name
-	maxSeqIndex  uint           // max seq index, based on SeqIndexWidth. e.g. 4 -> 9999
-	chLogEntry   chan *logEntry // channel for async write file
-	chSeqIndex   chan uint      // channel for generate auto increment seq index
-	chSeqInd     chan uint      // channel for signal, not in use now
-	chLogInd     chan uint
+	isEnabled   int32           // 1 if log enabled, read by log calls instead of IsEnable, atomic
+	isClosed    int32           // set to 1 by Close(), then logger can not be enabled any more
+	mutex       sync.Mutex      // lock for sinks
+	queueLock   chan struct{}   // lock for seq index and async queue, keep entries in order, see lockQueue()
+	closeMutex  sync.Mutex      // lock for Close()
+	isSinksDone bool            // set by Close() when all sinks closed
+	maxSeqIndex uint            // max seq index, based on SeqIndexWidth. e.g. 4 -> 9999
+	consoleSink *ConsoleSink    // built-in sink, enabled by IsWriteConsole
+	fileSink    *FileSink       // built-in sink, enabled by IsWriteFile
+	sinks       []Sink          // sinks added by AddSink()
+	chLogEntry  chan *LogEntry  // bounded queue for async write, nil if log stopped
+	chLogInd    chan uint       // closed when all entries in chLogEntry written
+	chFlush     chan chan error // channel for flush request to handleEntryChannel()
+	chSignal    chan os.Signal  // SIGHUP to handleSignal(), nil if not IsReopenOnSighup
+	exitFunc    func(code int)  // called by Fatal(), os.Exit if nil
+	helpers     sync.Map        // func names marked by Helper(), skipped to find caller of log call
+
+	errorMutex   sync.Mutex              // lock for errorRecords
+	errorRecords map[string]*errorRecord // errors logged by ErrorE() in dedup window, by level, tag and message
 }
 
 // -- New CeLogger
@@ -80,20 +124,20 @@ func NewCeLogger() *CeLogger {
 }
 
 func NewCeLoggerWithLogPath(filePath string) *CeLogger {
-	cl := &CeLogger{CeLoggerConfig: NewCeLoggerConfig()}
+	cl := &CeLogger{CeLoggerConfig: NewCeLoggerConfig(), ceLoggerState: newCeLoggerState()}
 
 	cl.LogFilePath = filePath
 	if cl.LogFilePath == "" {
 		// e.g. log_2006_01_02_15_04_05.log
 		cl.LogFilePath = fmt.Sprintf("log_%s.log", time.Now().Format("2006_01_02_15_04_05"))
-		cl.filename = cl.LogFilePath
 	}
+	cl.initSinks()
 
 	return cl
 }
 
 func NewCeLoggerWithConfig(filepath string) *CeLogger {
-	cl := &CeLogger{}
+	cl := &CeLogger{ceLoggerState: newCeLoggerState()}
 	cl.CeLoggerConfig = NewCeLoggerConfig()
 
 	cl.LoadConfigFile(filepath)
@@ -102,13 +146,58 @@ func NewCeLoggerWithConfig(filepath string) *CeLogger {
 	if cl.LogFilePath == "" {
 		// e.g. log_2006_01_02_15_04_05.log
 		cl.LogFilePath = fmt.Sprintf("log_%s.log", time.Now().Format("2006_01_02_15_04_05"))
-		cl.filename = cl.LogFilePath
 	}
+	cl.initSinks()
 
 	return cl
 }
 
-// -- Log type property: Trace/Info/Debug/Warn/Error/Panic
+func newCeLoggerState() *ceLoggerState {
+	return &ceLoggerState{queueLock: make(chan struct{}, 1)}
+}
+
+// -- Child logger
+
+// Child logger which shares sinks, seq index and config with cl,
+// and prepends fields to every entry. keyvals can be Field or key, value pairs
+func (cl *CeLogger) With(keyvals ...interface{}) *CeLogger {
+	child := cl.clone()
+	child.fields = append(child.fields, cl.getFields(keyvals)...)
+	return child
+}
+
+// Child logger which shares sinks, seq index and config with cl,
+// and prepends tag to user tag of every entry, e.g. "HTTP" + "GET" -> "HTTP.GET"
+func (cl *CeLogger) WithTag(tag string) *CeLogger {
+	child := cl.clone()
+	child.tag = child.getTag(tag)
+	return child
+}
+
+// Child logger which shares sinks, seq index and config with cl,
+// and skips n more frames to find caller of log call, e.g. 1 for logger used in a wrapper func.
+// It takes effect on func info, package of LevelRules, EnterFunc() and stack trace
+func (cl *CeLogger) AddCallerSkip(n int) *CeLogger {
+	child := cl.clone()
+	child.callerSkip += n
+	if child.callerSkip < 0 {
+		child.callerSkip = 0
+	}
+	return child
+}
+
+func (cl *CeLogger) clone() *CeLogger {
+	return &CeLogger{
+		CeLoggerConfig: cl.CeLoggerConfig,
+		ceLoggerState:  cl.ceLoggerState,
+		tag:            cl.tag,
+		fields:         cl.fields[:len(cl.fields):len(cl.fields)],
+		session:        cl.session,
+		callerSkip:     cl.callerSkip,
+	}
+}
+
+// -- Log type property: Trace/Info/Debug/Warn/Error/Panic/Fatal
 
 func (cl *CeLogger) IsLogTrace() bool {
 	return cl.ECMap[ECTrace].IsEnable
@@ -134,6 +223,81 @@ func (cl *CeLogger) IsLogPanic() bool {
 	return cl.ECMap[ECPanic].IsEnable
 }
 
+func (cl *CeLogger) IsLogFatal() bool {
+	return cl.ECMap[ECFatal].IsEnable
+}
+
+// Min level to log, "" means all
+func (cl *CeLogger) GetLevel() string {
+	return cl.Level
+}
+
+// Set min level to log, e.g. SetLevel(ECWarn) logs Warn/Error/Panic only, "" means all.
+// Level disabled by SetLogXXX(false) is not logged even if above it
+func (cl *CeLogger) SetLevel(level string) *CeLogger {
+	if _, ok := cl.ECMap[level]; level != "" && !ok {
+		fmt.Printf("Unknown level [%s]\n", level)
+		return cl
+	}
+	cl.Level = level
+	return cl
+}
+
+// Set min level of entries with user tag, child tags by WithTag() included,
+// e.g. SetTagLevel("HTTP", ECDebug) logs Debug of "HTTP" and "HTTP.GET" while Level is "Warn"
+func (cl *CeLogger) SetTagLevel(tag string, level string) *CeLogger {
+	return cl.setLevelRule(LevelRule{Tag: tag, Level: level})
+}
+
+// Set min level of entries logged by code in package, sub packages included,
+// e.g. SetPackageLevel("storage", ECDebug)
+func (cl *CeLogger) SetPackageLevel(pkg string, level string) *CeLogger {
+	return cl.setLevelRule(LevelRule{Package: pkg, Level: level})
+}
+
+// Remove all rules set by SetTagLevel()/SetPackageLevel()
+func (cl *CeLogger) ClearLevelRules() *CeLogger {
+	cl.LevelRules = nil
+	return cl
+}
+
+func (cl *CeLogger) setLevelRule(rule LevelRule) *CeLogger {
+	if _, ok := cl.ECMap[rule.Level]; rule.Level != "" && !ok {
+		fmt.Printf("Unknown level [%s]\n", rule.Level)
+		return cl
+	}
+
+	// Copy on write, rules may be read by other goroutines
+	rules := make([]LevelRule, 0, len(cl.LevelRules)+1)
+	for _, r := range cl.LevelRules {
+		if r.Tag != rule.Tag || r.Package != rule.Package {
+			rules = append(rules, r)
+		}
+	}
+	cl.LevelRules = append(rules, rule)
+	return cl
+}
+
+// Set stack trace capture of levels not below level, e.g. SetStackLevel(ECError), "" means none
+func (cl *CeLogger) SetStackLevel(level string) *CeLogger {
+	lc, ok := cl.ECMap[level]
+	if level != "" && !ok {
+		fmt.Printf("Unknown level [%s]\n", level)
+		return cl
+	}
+
+	for name, ec := range cl.ECMap {
+		ec.IsStack = level != "" && name != "" && ec.Severity >= lc.Severity
+	}
+	return cl
+}
+
+// Set max frames of stack trace
+func (cl *CeLogger) SetStackDepth(n uint) *CeLogger {
+	cl.StackDepth = n
+	return cl
+}
+
 func (cl *CeLogger) SetLogTrace(b bool) *CeLogger {
 	cl.ECMap[ECTrace].IsEnable = b
 	return cl
@@ -164,7 +328,15 @@ func (cl *CeLogger) SetLogPanic(b bool) *CeLogger {
 	return cl
 }
 
+func (cl *CeLogger) SetLogFatal(b bool) *CeLogger {
+	cl.ECMap[ECFatal].IsEnable = b
+	return cl
+}
+
 // -- log public functions: V/Vf/D/Df/I/If/W/Wf/E/Ef
+//
+// Functions end with "W" log msg with key/value fields,
+// e.g. InfoW("HTTP", "request done", "user", id, "latency", d)
 
 // Log Trace
 func (cl *CeLogger) Trace(tag string, e interface{}) *CeLogger {
@@ -175,6 +347,10 @@ func (cl *CeLogger) Tracef(tag string, format string, params ...interface{}) *Ce
 	return cl.logfWithTagColor(ECTrace, tag, format, params...)
 }
 
+func (cl *CeLogger) TraceW(tag string, msg string, keyvals ...interface{}) *CeLogger {
+	return cl.logwWithTagColor(ECTrace, tag, msg, keyvals...)
+}
+
 // Log Info
 func (cl *CeLogger) Info(tag string, e interface{}) *CeLogger {
 	return cl.logWithTagColor(ECInfo, tag, e)
@@ -184,6 +360,10 @@ func (cl *CeLogger) Infof(tag string, format string, params ...interface{}) *CeL
 	return cl.logfWithTagColor(ECInfo, tag, format, params...)
 }
 
+func (cl *CeLogger) InfoW(tag string, msg string, keyvals ...interface{}) *CeLogger {
+	return cl.logwWithTagColor(ECInfo, tag, msg, keyvals...)
+}
+
 // Log Debug
 func (cl *CeLogger) Debug(tag string, e interface{}) *CeLogger {
 	return cl.logWithTagColor(ECDebug, tag, e)
@@ -193,6 +373,10 @@ func (cl *CeLogger) Debugf(tag string, format string, params ...interface{}) *Ce
 	return cl.logfWithTagColor(ECDebug, tag, format, params...)
 }
 
+func (cl *CeLogger) DebugW(tag string, msg string, keyvals ...interface{}) *CeLogger {
+	return cl.logwWithTagColor(ECDebug, tag, msg, keyvals...)
+}
+
 // Log Warn
 func (cl *CeLogger) Warn(tag string, e interface{}) *CeLogger {
 	return cl.logWithTagColor(ECWarn, tag, e)
@@ -202,6 +386,10 @@ func (cl *CeLogger) Warnf(tag string, format string, params ...interface{}) *CeL
 	return cl.logfWithTagColor(ECWarn, tag, format, params...)
 }
 
+func (cl *CeLogger) WarnW(tag string, msg string, keyvals ...interface{}) *CeLogger {
+	return cl.logwWithTagColor(ECWarn, tag, msg, keyvals...)
+}
+
 // Log Error
 func (cl *CeLogger) Error(tag string, e interface{}) *CeLogger {
 	return cl.logWithTagColor(ECError, tag, e)
@@ -211,113 +399,301 @@ func (cl *CeLogger) Errorf(tag string, format string, params ...interface{}) *Ce
 	return cl.logfWithTagColor(ECError, tag, format, params...)
 }
 
-// Log Panic
+func (cl *CeLogger) ErrorW(tag string, msg string, keyvals ...interface{}) *CeLogger {
+	return cl.logwWithTagColor(ECError, tag, msg, keyvals...)
+}
+
+// Log Go error with its causes and stack trace, see ceLoggerError.go.
+// Identical errors within ErrorDedupWindow are logged once, then summarized
+func (cl *CeLogger) ErrorE(tag string, err error, keyvals ...interface{}) *CeLogger {
+	if err == nil {
+		return cl
+	}
+	return cl.logErrorWithTagColor(ECError, tag, err, keyvals...)
+}
+
+// Log Panic, then flush sinks and panic with content, unless IsPanicLogOnly.
+// It panics even if Panic is not logged
 func (cl *CeLogger) Panic(tag string, e interface{}) *CeLogger {
-	return cl.logWithTagColor(ECPanic, tag, e)
+	cl.logWithTagColor(ECPanic, tag, e)
+	return cl.panicOrExit(ECPanic, cl.getString(e))
 }
 
 func (cl *CeLogger) Panicf(tag string, format string, params ...interface{}) *CeLogger {
-	return cl.logfWithTagColor(ECPanic, tag, format, params...)
+	msg := fmt.Sprintf(format, params...)
+	cl.logWithTagColor(ECPanic, tag, msg)
+	return cl.panicOrExit(ECPanic, msg)
+}
+
+func (cl *CeLogger) PanicW(tag string, msg string, keyvals ...interface{}) *CeLogger {
+	cl.logwWithTagColor(ECPanic, tag, msg, keyvals...)
+	return cl.panicOrExit(ECPanic, msg)
+}
+
+// Log Fatal, then flush sinks and exit with code 1 by exit func, see SetExitFunc().
+// It exits even if Fatal is not logged
+func (cl *CeLogger) Fatal(tag string, e interface{}) *CeLogger {
+	cl.logWithTagColor(ECFatal, tag, e)
+	return cl.panicOrExit(ECFatal, cl.getString(e))
+}
+
+func (cl *CeLogger) Fatalf(tag string, format string, params ...interface{}) *CeLogger {
+	msg := fmt.Sprintf(format, params...)
+	cl.logWithTagColor(ECFatal, tag, msg)
+	return cl.panicOrExit(ECFatal, msg)
+}
+
+func (cl *CeLogger) FatalW(tag string, msg string, keyvals ...interface{}) *CeLogger {
+	cl.logwWithTagColor(ECFatal, tag, msg, keyvals...)
+	return cl.panicOrExit(ECFatal, msg)
+}
+
+// Log with level registered by RegisterLevel() or built-in one, e.g. Log("Audit", "User", "login")
+func (cl *CeLogger) Log(level string, tag string, e interface{}) *CeLogger {
+	return cl.logWithTagColor(level, tag, e)
+}
+
+func (cl *CeLogger) Logf(level string, tag string, format string, params ...interface{}) *CeLogger {
+	return cl.logfWithTagColor(level, tag, format, params...)
+}
+
+func (cl *CeLogger) LogW(level string, tag string, msg string, keyvals ...interface{}) *CeLogger {
+	return cl.logwWithTagColor(level, tag, msg, keyvals...)
 }
 
 // -- Enter & Exit Func
 
 func (cl *CeLogger) EnterFunc() (funcName string) {
-	if !cl.IsEnable || !cl.IsLogFuncEnterExit {
+	if !cl.isLogEnabled() || !cl.IsLogFuncEnterExit {
 		return ""
 	}
 
 	skip := 1
-	pc, _, _, _ := runtime.Caller(skip)
-	_, funcName = path.Split(runtime.FuncForPC(pc).Name())
-	cl.log("+ " + funcName)
+	frame, _ := cl.getCaller(skip)
+	_, funcName = path.Split(frame.Function)
+	cl.logFunc("+ " + funcName)
 
 	return funcName
 }
 
 func (cl *CeLogger) ExitFunc(funcName string) {
-	if !cl.IsEnable || !cl.IsLogFuncEnterExit {
+	if !cl.isLogEnabled() || !cl.IsLogFuncEnterExit {
 		return
 	}
 
-	cl.log("- " + funcName)
+	cl.logFunc("- " + funcName)
+}
+
+// -- Sink
+
+// Add sink to receive all log entries, besides built-in console and file
+func (cl *CeLogger) AddSink(s Sink) *CeLogger {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.sinks = append(cl.sinks, s)
+	return cl
+}
+
+// Remove sink added by AddSink(), the sink is flushed but not closed
+func (cl *CeLogger) RemoveSink(s Sink) *CeLogger {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	for i, sink := range cl.sinks {
+		if sink == s {
+			cl.sinks = append(cl.sinks[:i], cl.sinks[i+1:]...)
+			if err := s.Flush(); err != nil {
+				fmt.Println(err.Error())
+			}
+			break
+		}
+	}
+	return cl
+}
+
+// -- Flush & Close
+
+// Wait for all queued entries written, then flush and sync all sinks.
+// Return ctx.Err() if ctx done before that
+func (cl *CeLogger) Flush(ctx context.Context) error {
+	if err := cl.lockQueue(ctx); err != nil {
+		return err
+	}
+	chFlush, chLogInd := cl.chFlush, cl.chLogInd
+	cl.unlockQueue()
+
+	if chFlush != nil {
+		chErr := make(chan error, 1)
+		select {
+		case chFlush <- chErr:
+			select {
+			case err := <-chErr:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-chLogInd:
+			// Log stopped, no entry in queue any more
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	return cl.syncSinks()
+}
+
+// Stop log and close all sinks, further log calls are ignored.
+// Return ctx.Err() if ctx done before queued entries written, sinks are not closed then,
+// call Close() again to retry
+func (cl *CeLogger) Close(ctx context.Context) error {
+	cl.closeMutex.Lock()
+	defer cl.closeMutex.Unlock()
+
+	if cl.isSinksDone {
+		return nil
+	}
+
+	if cl.IsEnable {
+		cl.endErrorWindows()
+		atomic.StoreInt32(&cl.isEnabled, 0)
+		cl.IsEnable = false
+	}
+	atomic.StoreInt32(&cl.isClosed, 1)
+
+	if err := cl.stop(ctx); err != nil {
+		return err
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	var err error
+	for _, s := range append([]Sink{cl.consoleSink, cl.fileSink}, cl.sinks...) {
+		if e := s.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	cl.isSinksDone = true
+	return err
+}
+
+func (cl *CeLogger) IsClosed() bool {
+	return atomic.LoadInt32(&cl.isClosed) == 1
+}
+
+// If log enabled, safe to call concurrently with SetEnable() and Close()
+func (cl *CeLogger) isLogEnabled() bool {
+	return atomic.LoadInt32(&cl.isEnabled) == 1
+}
+
+// Reopen log files of file sink and sinks implementing Reopener,
+// e.g. after moved or truncated by logrotate
+func (cl *CeLogger) ReopenFiles() error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	err := cl.fileSink.Reopen()
+	for _, s := range cl.sinks {
+		if r, ok := s.(Reopener); ok {
+			if e := r.Reopen(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+
+	if err != nil {
+		fmt.Println("Reopen log files failed.", err.Error())
+	}
+	return err
 }
 
 // -- Get property
 
 func (cl *CeLogger) GetFilename() string {
-	return cl.filename
+	return cl.fileSink.GetFilename()
+}
+
+// Built-in console sink, enabled by IsWriteConsole
+func (cl *CeLogger) GetConsoleSink() *ConsoleSink {
+	return cl.consoleSink
+}
+
+// Built-in file sink, enabled by IsWriteFile
+func (cl *CeLogger) GetFileSink() *FileSink {
+	return cl.fileSink
+}
+
+// Entry count dropped by OverflowPolicy since log started
+func (cl *CeLogger) GetDropCount() uint64 {
+	return atomic.LoadUint64(&cl.dropCount)
 }
 
 // -- Set property
 
 func (cl *CeLogger) SetEnable(b bool) *CeLogger {
-	if cl.IsEnable == b {
+	if cl.IsEnable == b || cl.IsClosed() {
 		return cl
 	}
+	if !b {
+		// Summary of repeated errors before log stopped
+		cl.endErrorWindows()
+		atomic.StoreInt32(&cl.isEnabled, 0)
+	}
 	cl.IsEnable = b
 
 	if b {
 		cl.applyConfig()
 
 		// Init channel
-		cl.chSeqIndex = make(chan uint, cl.ChanLen)
-		cl.chLogEntry = make(chan *logEntry, cl.ChanLen)
-		//		if cl.chSeqInd == nil {
-		cl.chSeqInd = make(chan uint)
-		//		}
+		cl.chLogEntry = make(chan *LogEntry, cl.ChanLen)
 		//		if cl.chLogInd == nil {
 		cl.chLogInd = make(chan uint)
 		//		}
+		cl.chFlush = make(chan chan error)
 
-		cl.seqIndex = 1
-		cl.entryIndex = 0
-		cl.entryNum = 0
-		cl.fileSize = 0
-		cl.filename = cl.LogFilePath
-		cl.isFirstEntry = true
-		cl.readCount = 0
-		cl.writeCount = 0
+		if !cl.IsContinueSeqIndex || atomic.LoadUint64(&cl.seqIndex) == 0 {
+			atomic.StoreUint64(&cl.seqIndex, 1)
+		}
+		cl.fileSink.reset()
+		atomic.StoreUint64(&cl.dropCount, 0)
 
 		// Start channel routine
-		go cl.handleEntryChannel()
-		go cl.handleSeqIndexChannel()
+		go cl.handleEntryChannel(cl.chLogEntry, cl.chLogInd, cl.chFlush)
+
+		if cl.IsReopenOnSighup {
+			cl.chSignal = make(chan os.Signal, 1)
+			signal.Notify(cl.chSignal, syscall.SIGHUP)
+			go cl.handleSignal(cl.chSignal)
+		}
 
-		time.Sleep(time.Millisecond)
+		// Log calls see the queue created above once enabled
+		atomic.StoreInt32(&cl.isEnabled, 1)
 		fmt.Println("Log started")
 	} else {
 		fmt.Println("Log stopping ...")
 
-		// Notify to close chSeqIndex
-		//		fmt.Println("***** cl.chSeqInd <- 1")
-		cl.chSeqInd <- 1
+		if err := cl.stop(context.Background()); err != nil {
+			fmt.Println(err.Error())
+		}
 
-		// Wait for chLogEntry closed
-		//		if cl.readCount == cl.writeCount && len(cl.chLogEntry) == 0 {
-		//			close(cl.chLogEntry)
-		//		} else {
-		//			//			fmt.Println("***** <-cl.chLogInd")
-		//			<-cl.chLogInd
-		//		}
-		<-cl.chLogInd
-		time.Sleep(time.Millisecond)
 		fmt.Println("Log stopped")
 	}
 
 	return cl
 }
 
+// Set len of async queue, take effect at next SetEnable(true)
 func (cl *CeLogger) SetChanLen(n uint) *CeLogger {
-	if cl.ChanLen == n {
-		return cl
-	}
 	cl.ChanLen = n
+	return cl
+}
 
-	// TODO: If logger is working, need to do some process before set chLen
-	// TODO: Need to treat panic here
-	cl.chLogEntry = make(chan *logEntry, cl.ChanLen)
-	cl.chSeqIndex = make(chan uint, cl.ChanLen)
-
+func (cl *CeLogger) SetOverflowPolicy(policy string) *CeLogger {
+	cl.OverflowPolicy = policy
 	return cl
 }
 
@@ -330,6 +706,64 @@ func (cl *CeLogger) SetMaxEntryNum(n uint) *CeLogger {
 	return cl
 }
 
+// Set time based rotation, ""/Hourly/Daily or interval like "30m", invalid one is ignored
+func (cl *CeLogger) SetRotateTime(rotate string) *CeLogger {
+	if _, err := parseRotateTime(rotate); err != nil {
+		fmt.Printf("Invalid RotateTime [%s]: %s\n", rotate, err.Error())
+		return cl
+	}
+	cl.RotateTime = rotate
+	return cl
+}
+
+// Set time layout of rotated filename, e.g. "log_2006_01_02.log"
+func (cl *CeLogger) SetRotateFilePattern(pattern string) *CeLogger {
+	cl.RotateFilePattern = pattern
+	return cl
+}
+
+// Set max count of rotated log files, the oldest are removed in background, 0 means no limit
+func (cl *CeLogger) SetMaxBackups(n uint) *CeLogger {
+	cl.MaxBackups = n
+	return cl
+}
+
+// Set max age in hours of rotated log files, 0 means no limit
+func (cl *CeLogger) SetMaxAge(hours uint) *CeLogger {
+	cl.MaxAge = hours
+	return cl
+}
+
+// Set max total size of current and rotated log files, 0 means no limit
+func (cl *CeLogger) SetMaxTotalSize(n uint) *CeLogger {
+	cl.MaxTotalSize = n
+	return cl
+}
+
+// Set if gzip rotated log files in background
+func (cl *CeLogger) SetCompress(b bool) *CeLogger {
+	cl.IsCompress = b
+	return cl
+}
+
+// Set how log files are named when MaxFileSize or MaxEntryNum reached, Increment/Shift
+func (cl *CeLogger) SetRotateScheme(scheme string) *CeLogger {
+	cl.RotateScheme = scheme
+	return cl
+}
+
+// Set if continue the last log file on start until limits reached, instead of a new one
+func (cl *CeLogger) SetAppendOnStart(b bool) *CeLogger {
+	cl.IsAppendOnStart = b
+	return cl
+}
+
+// Set if reopen log files on SIGHUP, take effect at next SetEnable(true)
+func (cl *CeLogger) SetReopenOnSighup(b bool) *CeLogger {
+	cl.IsReopenOnSighup = b
+	return cl
+}
+
 func (cl *CeLogger) SetSyncWriteFile(b bool) *CeLogger {
 	cl.IsSyncWriteFile = b
 	return cl
@@ -345,6 +779,11 @@ func (cl *CeLogger) SetLogSeqIndex(b bool) *CeLogger {
 	return cl
 }
 
+func (cl *CeLogger) SetContinueSeqIndex(b bool) *CeLogger {
+	cl.IsContinueSeqIndex = b
+	return cl
+}
+
 func (cl *CeLogger) SetSeqIndexWidth(n uint) *CeLogger {
 	cl.SeqIndexWidth = n
 	cl.maxSeqIndex = 0
@@ -412,15 +851,72 @@ func (cl *CeLogger) SetLogOrderFlag(b bool) *CeLogger {
 	return cl
 }
 
+func (cl *CeLogger) SetLogFormat(format string) *CeLogger {
+	cl.LogFormat = format
+	return cl
+}
+
+// Set template of text format, default bracketed text is used if empty or invalid
+// e.g. "{time} {level:-5} [{tag}] {caller}: {msg}"
+func (cl *CeLogger) SetTextTemplate(tmpl string) *CeLogger {
+	if err := cl.CompileTextTemplate(tmpl); err != nil {
+		fmt.Printf("Compile text template [%s] failed: %s\n", tmpl, err.Error())
+	}
+	return cl
+}
+
+// Set if write each session to its own file, take effect at next StartSession()
+func (cl *CeLogger) SetSessionFile(b bool) *CeLogger {
+	cl.IsSessionFile = b
+	return cl
+}
+
 func (cl *CeLogger) SetContentDelimiter(str string) *CeLogger {
 	cl.ContentDelimiter = str
 	return cl
 }
 
+func (cl *CeLogger) SetFileBufferSize(n uint) *CeLogger {
+	cl.FileBufferSize = n
+	return cl
+}
+
+func (cl *CeLogger) SetFlushInterval(ms uint) *CeLogger {
+	cl.FlushInterval = ms
+	return cl
+}
+
 func (cl *CeLogger) SetLogFilePath(filePath string) *CeLogger {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
 	cl.LogFilePath = filePath
-	cl.filename = filePath
+	cl.fileSink.setFilename(filePath)
+
+	return cl
+}
+
+// Set symlink always pointing to current log file, e.g. "app.current.log", "" means no link
+func (cl *CeLogger) SetCurrentLinkPath(path string) *CeLogger {
+	cl.CurrentLinkPath = path
+	return cl
+}
 
+// Set func called by Fatal() after flush, nil means os.Exit, e.g. to test Fatal()
+func (cl *CeLogger) SetExitFunc(f func(code int)) *CeLogger {
+	cl.exitFunc = f
+	return cl
+}
+
+// Set if Panic() only logs like old versions, instead of flush and panic
+func (cl *CeLogger) SetPanicLogOnly(b bool) *CeLogger {
+	cl.IsPanicLogOnly = b
+	return cl
+}
+
+// Set dedup window in ms of ErrorE(), 0 means every error is logged
+func (cl *CeLogger) SetErrorDedupWindow(ms uint) *CeLogger {
+	cl.ErrorDedupWindow = ms
 	return cl
 }
 
@@ -430,267 +926,372 @@ func (cl *CeLogger) SetConfigFilePath(filePath string) *CeLogger {
 
 // -- private log function
 
-func (cl *CeLogger) log(e interface{}) *CeLogger {
-	if !cl.IsEnable {
-		return cl
+// Log entry, stack is captured if nil and ec.IsStack. Return the entry, nil if not logged
+func (cl *CeLogger) log(etName string, ec *EntryConfig, tag string, e interface{}, fields []Field, stack []StackFrame) *LogEntry {
+	if !cl.isLogEnabled() {
+		return nil
 	}
 
-	var buf bytes.Buffer
-
-	if cl.IsLogOrderFlag {
-		buf.WriteString(" ")
+	entry := &LogEntry{
+		Time:    time.Now(),
+		Level:   etName,
+		Tag:     cl.getTag(tag),
+		Content: cl.getString(e),
+		Fields:  fields,
+		ec:      ec,
 	}
-
-	// Sequence index
-	i := cl.getSeqIndex()
-	if cl.IsLogSeqIndex && i > 0 {
-		buf.WriteString(cl.getSeqIndexString(i))
+	if len(cl.fields) > 0 {
+		entry.Fields = append(cl.fields[:len(cl.fields):len(cl.fields)], fields...)
+	}
+	if cl.session != nil {
+		cl.session.stamp(entry)
+	}
+	cl.setFuncInfo(entry)
+	entry.Stack = stack
+	if stack == nil && ec != nil && ec.IsStack {
+		entry.Stack = cl.getStack()
 	}
-	buf.WriteString(cl.getDateTimeString())
-	buf.WriteString(cl.getFuncInfoString())
-
-	// Default is " "
-	buf.WriteString(cl.ContentDelimiter)
-
-	// Real cl content
-	buf.WriteString(cl.getString(e))
 
 	// Write log entry
-	cl.writeEntry(&logEntry{i, buf.Bytes()})
+	cl.writeEntry(entry)
 
-	return cl
+	return entry
 }
 
-func (cl *CeLogger) logf(format string, params ...interface{}) *CeLogger {
-	if !cl.IsEnable {
-		return cl
-	}
-
-	cl.log(fmt.Sprintf(format, params...))
-
+// Log func enter/exit, without tag and color
+func (cl *CeLogger) logFunc(e interface{}) *CeLogger {
+	cl.log("", nil, "", e, nil, nil)
 	return cl
 }
 
 func (cl *CeLogger) logWithTagColor(etName, tag string, e interface{}) *CeLogger {
-	if !cl.IsEnable {
+	if !cl.isLogEnabled() {
 		return cl
 	}
 
 	ec, ok := cl.ECMap[etName]
 	if !ok {
+		etName = ""
 		ec = cl.ECMap[""]
 	}
-	if !ec.IsEnable {
+	if !ec.IsEnable || !cl.isAboveLevel(cl.getEntryLevel(tag, 1), ec) {
 		return cl
 	}
 
-	var s string
-	if cl.IsLogEntryTag {
-		s = cl.getTagString(ec.Tag)
+	cl.log(etName, ec, tag, e, nil, nil)
+	return cl
+}
+
+func (cl *CeLogger) logfWithTagColor(etName, tag string, format string, params ...interface{}) *CeLogger {
+	ec, ok := cl.ECMap[etName]
+	if !ok {
+		etName = ""
+		ec = cl.ECMap[""]
+	}
+	if !cl.IsEnable || !ec.IsEnable || !cl.isAboveLevel(cl.getEntryLevel(tag, 1), ec) {
+		return cl
 	}
 
-	var buf bytes.Buffer
-	if cl.IsLogColor {
-		buf.WriteString(cl.GetColorString(s+cl.getTagString(tag)+cl.getString(e), ec))
-	} else {
-		buf.WriteString(s + cl.getTagString(tag) + cl.getString(e))
+	cl.log(etName, ec, tag, fmt.Sprintf(format, params...), nil, nil)
+	return cl
+}
+
+func (cl *CeLogger) logwWithTagColor(etName, tag string, msg string, keyvals ...interface{}) *CeLogger {
+	ec, ok := cl.ECMap[etName]
+	if !ok {
+		etName = ""
+		ec = cl.ECMap[""]
+	}
+	if !cl.IsEnable || !ec.IsEnable || !cl.isAboveLevel(cl.getEntryLevel(tag, 1), ec) {
+		return cl
 	}
-	cl.log(buf.String())
 
+	cl.log(etName, ec, tag, msg, cl.getFields(keyvals), nil)
 	return cl
 }
 
-func (cl *CeLogger) logfWithTagColor(etName, tag string, format string, params ...interface{}) *CeLogger {
+func (cl *CeLogger) logErrorWithTagColor(etName, tag string, err error, keyvals ...interface{}) *CeLogger {
 	ec, ok := cl.ECMap[etName]
 	if !ok {
+		etName = ""
 		ec = cl.ECMap[""]
 	}
-	if !cl.IsEnable || !ec.IsEnable {
+	if !cl.IsEnable || !ec.IsEnable || !cl.isAboveLevel(cl.getEntryLevel(tag, 1), ec) {
 		return cl
 	}
 
-	var s string
-	if cl.IsLogEntryTag {
-		s = cl.getTagString(ec.Tag)
+	key := etName + "\n" + cl.getTag(tag) + "\n" + err.Error()
+	rec := cl.startErrorWindow(key)
+	if rec == nil {
+		// Repeated in dedup window
+		return cl
 	}
 
-	var buf bytes.Buffer
-	if cl.IsLogColor {
-		buf.WriteString(cl.GetColorString(s+cl.getTagString(tag)+fmt.Sprintf(format, params...), ec))
-	} else {
-		buf.WriteString(s + cl.getTagString(tag) + fmt.Sprintf(format, params...))
+	fields := append(cl.getFields(keyvals), cl.getErrorFields(err)...)
+	entry := cl.log(etName, ec, tag, err.Error(), fields, cl.getErrorStack(err))
+	cl.setErrorEntry(rec, entry)
+
+	return cl
+}
+
+// Max time to flush sinks before panic or exit
+const panicFlushTimeout = 5 * time.Second
+
+// Flush sinks, then panic with msg for Panic, or exit with code 1 for Fatal
+func (cl *CeLogger) panicOrExit(etName string, msg string) *CeLogger {
+	if etName == ECPanic && cl.IsPanicLogOnly {
+		return cl
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), panicFlushTimeout)
+	if err := cl.Flush(ctx); err != nil {
+		fmt.Println(err.Error())
 	}
-	cl.log(buf.String())
+	cancel()
 
+	if etName == ECPanic {
+		panic(msg)
+	}
+
+	if cl.exitFunc != nil {
+		cl.exitFunc(1)
+	} else {
+		os.Exit(1)
+	}
 	return cl
 }
 
 // Write log entry
-func (cl *CeLogger) writeEntry(entry *logEntry) *CeLogger {
-	if !cl.IsEnable {
+func (cl *CeLogger) writeEntry(entry *LogEntry) *CeLogger {
+	if !cl.isLogEnabled() {
 		return cl
 	}
 
-	if cl.IsWriteConsole {
-		fmt.Println(string(entry.buf))
+	if cl.IsSyncWriteFile {
+		// Sync write sinks
+		cl.mutex.Lock()
+		if !cl.IsClosed() {
+			entry.Index = cl.getSeqIndex()
+			cl.writeSinks(entry)
+		}
+		cl.mutex.Unlock()
+	} else {
+		// Async write sinks by handleEntryChannel()
+		cl.lockQueue(context.Background())
+		if cl.chLogEntry != nil {
+			entry.Index = cl.getSeqIndex()
+			cl.pushEntry(entry)
+		}
+		cl.unlockQueue()
 	}
 
-	if cl.IsWriteFile {
-		if cl.IsSyncWriteFile {
-			cl.mutex.Lock()
-			defer cl.mutex.Unlock()
+	return cl
+}
 
-			// Sync write file
-			err := cl.writeEntryToFile(entry)
-			if err != nil {
-				fmt.Println(err.Error())
+// Push log entry to async queue, drop entry by OverflowPolicy if queue is full.
+// Queue lock must be held, it is held while blocked on full queue
+func (cl *CeLogger) pushEntry(entry *LogEntry) {
+	switch cl.OverflowPolicy {
+	case OverflowDropNewest:
+		select {
+		case cl.chLogEntry <- entry:
+		default:
+			atomic.AddUint64(&cl.dropCount, 1)
+			return
+		}
+	case OverflowDropOldest:
+		select {
+		case cl.chLogEntry <- entry:
+		default:
+			select {
+			case <-cl.chLogEntry:
+				atomic.AddUint64(&cl.dropCount, 1)
+			default:
 			}
-		} else {
-			// Async write file
-			go func(e *logEntry) {
-				if !cl.IsEnable {
-					return
-				}
+			// Never block, only handleEntryChannel() reads chLogEntry besides us
+			cl.chLogEntry <- entry
+		}
+	default:
+		cl.chLogEntry <- entry
+	}
+}
 
-				cl.writeCount++
-				cl.chLogEntry <- e
-			}(entry)
+// Write log entry to built-in sinks and sinks added by AddSink(), cl.mutex must be held
+func (cl *CeLogger) writeSinks(entry *LogEntry) {
+	if cl.IsWriteConsole && entry.isWriteConsole() && cl.isAboveLevel(cl.consoleSink.GetLevel(), entry.ec) {
+		if err := cl.consoleSink.WriteEntry(entry); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
 
-			time.Sleep(time.Nanosecond)
+	if cl.IsWriteFile && entry.isWriteFile() && cl.isAboveLevel(cl.fileSink.GetLevel(), entry.ec) {
+		if err := cl.fileSink.WriteEntry(entry); err != nil {
+			fmt.Println(err.Error())
 		}
+	} else {
+		cl.fileSink.skipEntry(entry)
 	}
 
-	return cl
+	for _, s := range cl.sinks {
+		if l, ok := s.(Leveler); ok && !cl.isAboveLevel(l.GetLevel(), entry.ec) {
+			if sk, ok := s.(entrySkipper); ok {
+				sk.skipEntry(entry)
+			}
+			continue
+		}
+		if err := s.WriteEntry(entry); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+
+	// Flush right after important entry, e.g. Error/Panic
+	if entry.ec != nil && entry.ec.IsFlush {
+		cl.flushSinks()
+	}
 }
 
-func (cl *CeLogger) writeEntryToFile(entry *logEntry) error {
-	if cl.IsLogOrderFlag {
-		// Mark "X" in front of log entry if out of order
-		if !(entry.i == cl.entryIndex+1 ||
-			(entry.i == 1 && cl.entryIndex == uint(math.Pow10(int(cl.SeqIndexWidth)))-1)) {
-			entry.buf[0] = 'X'
+// Flush all sinks, cl.mutex must be held
+func (cl *CeLogger) flushSinks() (err error) {
+	for _, s := range append([]Sink{cl.consoleSink, cl.fileSink}, cl.sinks...) {
+		if e := s.Flush(); e != nil {
+			fmt.Println(e.Error())
+			if err == nil {
+				err = e
+			}
 		}
 	}
+	return err
+}
+
+// Flush all sinks, then sync sinks which implement Syncer. cl.mutex must be held
+func (cl *CeLogger) syncSinks() error {
+	err := cl.flushSinks()
 
-	// If this is the first entry, check log file if available
-	// Refresh log.filename if nesessary
-	if cl.isFirstEntry {
-		if cl.MaxFileSize > 0 || cl.MaxEntryNum > 0 {
-			if _, err := os.Stat(cl.LogFilePath); os.IsNotExist(err) {
-				// If log file not exist
-				cl.filename = cl.LogFilePath
-			} else {
-				// If log file exist, try to get next one
-				// e.g. "test.log" -> "test_1.log"
-				cl.filename = cl.getNextValidFilename(cl.LogFilePath)
+	for _, s := range append([]Sink{cl.consoleSink, cl.fileSink}, cl.sinks...) {
+		if syncer, ok := s.(Syncer); ok {
+			if e := syncer.Sync(); e != nil && err == nil {
+				err = e
 			}
 		}
-		cl.isFirstEntry = false
 	}
+	return err
+}
 
-	// Write to a new log file if necessary
-	if (cl.MaxEntryNum > 0 && cl.entryNum >= cl.MaxEntryNum) ||
-		(cl.MaxFileSize > 0 && cl.fileSize+uint(len(entry.buf))+1 >= cl.MaxFileSize) {
-		cl.filename = cl.getNextValidFilename(cl.LogFilePath)
-		// reset log tracking data
-		cl.fileSize = 0
-		cl.entryNum = 0
+// Close async queue and wait for all entries in it written, then sync sinks and close log file.
+// Return ctx.Err() if ctx done before entries written, it can be called again to continue
+func (cl *CeLogger) stop(ctx context.Context) error {
+	if cl.chSignal != nil {
+		signal.Stop(cl.chSignal)
+		close(cl.chSignal)
+		cl.chSignal = nil
 	}
 
-	// Write buf to log file
-	size, err := cl.writeLogFile(entry.buf)
-	if err != nil {
-		fmt.Sprintf("writeLogFile failed at %d, %s\n", entry.i, err.Error())
+	if err := cl.lockQueue(ctx); err != nil {
 		return err
 	}
+	if cl.chLogEntry != nil {
+		close(cl.chLogEntry)
+		cl.chLogEntry = nil
+		cl.chFlush = nil
+	}
+	cl.unlockQueue()
 
-	// Update log tracking data
-	cl.entryIndex = entry.i
-	cl.fileSize += size
-	cl.entryNum++
+	if cl.chLogInd != nil {
+		select {
+		case <-cl.chLogInd:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 
-	return nil
-}
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
 
-// Write buffer to log file, return size of write bytes
-func (cl *CeLogger) writeLogFile(buf []byte) (size uint, err error) {
-	file, err := os.OpenFile(cl.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
-	if err != nil {
-		fmt.Println("Write log failed.", err.Error())
-		return 0, err
+	err := cl.syncSinks()
+	if e := cl.fileSink.Close(); e != nil && err == nil {
+		err = e
 	}
-	defer file.Close()
+	return err
+}
 
-	file.Write(buf)
-	file.WriteString("\n")
+func (cl *CeLogger) initSinks() {
+	cl.consoleSink = NewConsoleSink(cl.CeLoggerConfig)
+	cl.fileSink = NewFileSink(cl.CeLoggerConfig)
+}
 
-	return uint(len(buf)) + 1, nil
+// Lock async queue, return ctx.Err() if ctx done before locked.
+// Writer blocked on full queue holds the lock, so it can not be a sync.Mutex
+func (cl *CeLogger) lockQueue(ctx context.Context) error {
+	select {
+	case cl.queueLock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (cl *CeLogger) handleEntryChannel() {
-	var timer *time.Timer
-Loop:
+func (cl *CeLogger) unlockQueue() {
+	<-cl.queueLock
+}
+
+// The only writer of async queue, write entries to sinks in order until chLogEntry closed,
+// then close chLogInd. Also flush sinks every FlushInterval ms, and serve Flush() request
+func (cl *CeLogger) handleEntryChannel(chLogEntry chan *LogEntry, chLogInd chan uint, chFlush chan chan error) {
+	defer close(chLogInd)
+
+	var chTick <-chan time.Time
+	if cl.FlushInterval > 0 {
+		ticker := time.NewTicker(time.Duration(cl.FlushInterval) * time.Millisecond)
+		defer ticker.Stop()
+		chTick = ticker.C
+	}
+
 	for {
 		select {
-		case entry, ok := <-cl.chLogEntry:
+		case entry, ok := <-chLogEntry:
 			if !ok {
-				//fmt.Println("chLogEntry is closed")
-				break Loop
+				return
 			}
 
-			cl.readCount++
-			if err := cl.writeEntryToFile(entry); err != nil {
-				fmt.Printf("writeEntryToFile failed: %s\n", err.Error())
-			}
-		case <-func() <-chan time.Time {
-			if timer == nil {
-				timer = time.NewTimer(time.Millisecond * 20)
-			} else {
-				timer.Reset(time.Millisecond * 20)
-			}
-			return timer.C
-		}():
-			// If stop logger, close chLogEntry when read = write
-			if !cl.IsEnable && (cl.writeCount == cl.readCount) {
-				//fmt.Println("close chLogEntry")
-				close(cl.chLogEntry)
-				cl.chLogInd <- 1
+			cl.mutex.Lock()
+			cl.writeSinks(entry)
+			cl.mutex.Unlock()
+		case chErr := <-chFlush:
+			// Write all entries queued before flush request
+			cl.mutex.Lock()
+		Drain:
+			for {
+				select {
+				case entry, ok := <-chLogEntry:
+					if !ok {
+						break Drain
+					}
+					cl.writeSinks(entry)
+				default:
+					break Drain
+				}
 			}
+			chErr <- cl.syncSinks()
+			cl.mutex.Unlock()
+		case <-chTick:
+			cl.mutex.Lock()
+			cl.flushSinks()
+			cl.mutex.Unlock()
 		}
 	}
-
-	//	fmt.Println("***** - handleEntryChannel")
 }
 
-func (cl *CeLogger) handleSeqIndexChannel() {
-Loop:
-	for {
-		select {
-		case cl.chSeqIndex <- cl.seqIndex:
-			cl.seqIndex++
-
-			if cl.SeqIndexWidth > 0 {
-				if cl.maxSeqIndex == 0 {
-					cl.SetSeqIndexWidth(cl.SeqIndexWidth)
-				}
-
-				if cl.seqIndex >= cl.maxSeqIndex {
-					cl.seqIndex = 1
-				}
-			}
-		case _ = <-cl.chSeqInd:
-			//fmt.Println("close chSeqIndex", flag)
-			close(cl.chSeqIndex)
-			break Loop
-		}
+// Reopen log files on SIGHUP until chSignal closed by stop()
+func (cl *CeLogger) handleSignal(chSignal chan os.Signal) {
+	for range chSignal {
+		cl.ReopenFiles()
 	}
-	//	fmt.Println("***** - handleSeqIndexChannel")
 }
 
 // -- private helper function
 
 // Convert everything to string
-func (cl *CeLogger) getString(e interface{}) string {
+func (c *CeLoggerConfig) getString(e interface{}) string {
 	type Stringer interface {
 		String() string
 	}
@@ -709,95 +1310,228 @@ func (cl *CeLogger) getString(e interface{}) string {
 	}
 }
 
+// User tag with tag set by WithTag()
+// e.g. "HTTP" + "GET" -> "HTTP.GET"
+func (cl *CeLogger) getTag(tag string) string {
+	switch {
+	case cl.tag == "":
+		return tag
+	case tag == "":
+		return cl.tag
+	default:
+		return cl.tag + "." + tag
+	}
+}
+
 // Index
 // e.g. 12
 func (cl *CeLogger) getSeqIndex() uint {
-	if !cl.IsEnable || !cl.IsLogSeqIndex {
+	if !cl.isLogEnabled() || !cl.IsLogSeqIndex {
 		return 0
 	}
 
-	// TODO: Need to take care of blocking at chSeqIndex
-	i, ok := <-cl.chSeqIndex
+	// Lock free, wrap around to 1 when reach maxSeqIndex
+	for {
+		i := atomic.LoadUint64(&cl.seqIndex)
+		next := i + 1
+		if cl.maxSeqIndex > 0 && next >= uint64(cl.maxSeqIndex) {
+			next = 1
+		}
+
+		if atomic.CompareAndSwapUint64(&cl.seqIndex, i, next) {
+			return uint(i)
+		}
+	}
+}
+
+// Min level of entry by the most specific matched rule of LevelRules, then Level, see isRuleMoreSpecific().
+// tag is user tag, skip is count of frames between caller of getEntryLevel() and user code,
+// e.g. 1 for logWithTagColor() called by Info(). Caller package is only looked up if any rule of package
+func (cl *CeLogger) getEntryLevel(tag string, skip int) string {
+	rules := cl.LevelRules
+	if len(rules) == 0 {
+		return cl.Level
+	}
+
+	tag = cl.getTag(tag)
+	pkg, isPkgFound := "", false
+	var matched *LevelRule
+	for i, r := range rules {
+		if r.Tag != "" && tag != r.Tag && !strings.HasPrefix(tag, r.Tag+".") {
+			continue
+		}
+		if matched != nil && !isRuleMoreSpecific(r, *matched) {
+			continue
+		}
+		if r.Package != "" {
+			if !isPkgFound {
+				frame, _ := cl.getCaller(skip + 2)
+				pkg, isPkgFound = getFuncPackage(frame.Function), true
+			}
+			if !isPackageMatched(pkg, r.Package) {
+				continue
+			}
+		}
+		matched = &rules[i]
+	}
+
+	if matched == nil {
+		return cl.Level
+	}
+	return matched.Level
+}
+
+// If rule a is more specific than b, by longer Tag, then longer Package,
+// e.g. "HTTP.GET" > "HTTP" > "", "github.com/a/storage" > "storage"
+func isRuleMoreSpecific(a, b LevelRule) bool {
+	if len(a.Tag) != len(b.Tag) {
+		return len(a.Tag) > len(b.Tag)
+	}
+	return len(a.Package) > len(b.Package)
+}
+
+// Package path of full func name,
+// e.g. "github.com/a/storage.(*DB).Get" -> "github.com/a/storage"
+func getFuncPackage(name string) string {
+	i := strings.LastIndex(name, "/") + 1
+	if n := strings.Index(name[i:], "."); n >= 0 {
+		name = name[:i+n]
+	}
+	return name
+}
+
+// If pkg is rule or its sub package, rule can be the last part of path,
+// e.g. "storage" matches "github.com/a/storage" and "github.com/a/storage/sql"
+func isPackageMatched(pkg, rule string) bool {
+	return pkg == rule || strings.HasPrefix(pkg, rule+"/") ||
+		strings.HasSuffix(pkg, "/"+rule) || strings.Contains(pkg, "/"+rule+"/")
+}
+
+// Set func info of log entry
+func (cl *CeLogger) setFuncInfo(entry *LogEntry) {
+	if !(cl.IsLogCodeFilename || cl.IsLogCodeFuncName) {
+		return
+	}
+
+	skip := 4
+	frame, ok := cl.getCaller(skip)
 	if !ok {
-		fmt.Println("SeqIndex chan closed")
-		return 0
+		return
 	}
-	return i
+
+	_, entry.File = path.Split(frame.File)
+	entry.Line = frame.Line
+	_, entry.Func = path.Split(frame.Function)
+}
+
+// Text of log entry, tag and content are colorized if isColor
+// e.g. [0012][15:16:17.1234](main.test) [I][HTTP]content
+func (c *CeLoggerConfig) FormatText(entry *LogEntry, isColor bool) []byte {
+	if c.textTemplate != nil {
+		return c.formatTextTemplate(entry, isColor)
+	}
+
+	var buf bytes.Buffer
+
+	if c.IsLogOrderFlag {
+		buf.WriteString(" ")
+	}
+
+	// Sequence index
+	if c.IsLogSeqIndex && entry.Index > 0 {
+		buf.WriteString(c.getSeqIndexString(entry.Index))
+	}
+	buf.WriteString(c.getDateTimeString(entry.Time))
+	buf.WriteString(c.getFuncInfoString(entry))
+
+	// Default is " "
+	buf.WriteString(c.ContentDelimiter)
+
+	// Real log content
+	if entry.ec == nil {
+		buf.WriteString(entry.Content + c.getFieldsString(entry.Fields))
+	} else {
+		var s string
+		if c.IsLogEntryTag {
+			s = c.getTagString(entry.ec.Tag)
+		}
+		s += c.getTagString(entry.Tag) + entry.Content + c.getFieldsString(entry.Fields)
+
+		if isColor {
+			s = c.GetColorString(s, entry.ec)
+		}
+		buf.WriteString(s)
+	}
+	buf.WriteString(c.getStackString(entry.Stack))
+
+	return buf.Bytes()
 }
 
 // Index string
 // [Index], e.g. [0012]
-func (cl *CeLogger) getSeqIndexString(i uint) string {
-	if cl.SeqIndexWidth == 0 {
+func (c *CeLoggerConfig) getSeqIndexString(i uint) string {
+	if c.SeqIndexWidth == 0 {
 		return ""
 	}
-	s := strconv.Itoa(int(cl.SeqIndexWidth))
+	s := strconv.Itoa(int(c.SeqIndexWidth))
 	return fmt.Sprintf("[%0"+s+"d]", i)
 }
 
 // Date time string
 // [date time], e.g. [2015-03-04 15:16:17]
-func (cl *CeLogger) getDateTimeString() string {
-	if !cl.IsEnable {
-		return ""
-	}
-
-	if !(cl.IsLogDate || cl.IsLogTime) {
+func (c *CeLoggerConfig) getDateTimeString(t time.Time) string {
+	if !(c.IsLogDate || c.IsLogTime) {
 		return ""
 	}
 
-	t := time.Now()
-
 	var buf bytes.Buffer
 
 	buf.WriteString("[")
 
-	if cl.IsLogDate {
+	if c.IsLogDate {
 		buf.WriteString(t.Format("2006-01-02"))
 	}
 
-	if cl.IsLogTime {
+	if c.IsLogTime {
 		if buf.Len() > 1 {
 			buf.WriteString(" ")
 		}
 
-		if cl.TimeMsWidth == 0 {
-			s := t.Format("15:04:05")
-			buf.WriteString(s)
-		} else {
-			s := t.Format("15:04:05.999999999")
-			n := len("15:04:05.") + int(cl.TimeMsWidth) - len(s)
-
-			switch {
-			case n < 0:
-				buf.WriteString(s[:len(s)+n])
-			case n == 0:
-				buf.WriteString(s)
-			case n > 0:
-				buf.WriteString(s)
-				buf.WriteString(strings.Repeat("0", n))
-			}
-		}
+		buf.WriteString(c.getTimeString(t))
 	}
 
 	buf.WriteString("]")
 	return buf.String()
 }
 
-// Func info
-// (filename:line-package.func), e.g. (abc.go:12-main.test)
-func (cl *CeLogger) getFuncInfoString() string {
-	if !cl.IsEnable {
-		return ""
+// Time string with TimeMsWidth
+// e.g. 15:16:17.1234
+func (c *CeLoggerConfig) getTimeString(t time.Time) string {
+	if c.TimeMsWidth == 0 {
+		return t.Format("15:04:05")
 	}
 
-	if !(cl.IsLogCodeFilename || cl.IsLogCodeFuncName) {
+	s := t.Format("15:04:05.999999999")
+	n := len("15:04:05.") + int(c.TimeMsWidth) - len(s)
+
+	switch {
+	case n < 0:
+		return s[:len(s)+n]
+	case n > 0:
+		return s + strings.Repeat("0", n)
+	default:
+		return s
+	}
+}
+
+// Func info
+// (filename:line-package.func), e.g. (abc.go:12-main.test)
+func (c *CeLoggerConfig) getFuncInfoString(entry *LogEntry) string {
+	if !(c.IsLogCodeFilename || c.IsLogCodeFuncName) {
 		return ""
 	}
 
-	skip := 4
-	pc, filename, lineNumber, ok := runtime.Caller(skip)
-	if !ok {
+	if entry.File == "" && entry.Func == "" {
 		return ""
 	}
 
@@ -805,24 +1539,22 @@ func (cl *CeLogger) getFuncInfoString() string {
 
 	buf.WriteString("(")
 
-	if cl.IsLogCodeFilename {
-		_, f := path.Split(filename)
-		buf.WriteString(f)
+	if c.IsLogCodeFilename {
+		buf.WriteString(entry.File)
 
-		if cl.IsLogCodeLineNumber {
-			buf.WriteString(fmt.Sprintf(":%d", lineNumber))
+		if c.IsLogCodeLineNumber {
+			buf.WriteString(fmt.Sprintf(":%d", entry.Line))
 			//buf.WriteString(":")
 			//buf.WriteString(strconv.Itoa(lineNumber))
 		}
 	}
 
-	if cl.IsLogCodeFuncName {
+	if c.IsLogCodeFuncName {
 		if buf.Len() > 1 {
 			buf.WriteString("-")
 		}
-		_, funcName := path.Split(runtime.FuncForPC(pc).Name())
 
-		buf.WriteString(funcName)
+		buf.WriteString(entry.Func)
 	}
 
 	buf.WriteString(")")
@@ -831,7 +1563,7 @@ func (cl *CeLogger) getFuncInfoString() string {
 
 // Tag string
 // [tag], e.g. [HTTP]
-func (cl *CeLogger) getTagString(tag string) string {
+func (c *CeLoggerConfig) getTagString(tag string) string {
 	var buf bytes.Buffer
 
 	buf.WriteString("[")
@@ -913,45 +1645,9 @@ func (c *CeLoggerConfig) GetColorString(str string, ec *EntryConfig) string {
 	return buf.String()
 }
 
-func (cl *CeLogger) getFilenameExt(path string) (name, ext string) {
-	for i := len(path) - 1; i >= 0 && path[i] != '/'; i-- {
-		if path[i] == '.' {
-			return path[:i], path[i+1:]
-		}
-	}
-	return path, ""
-}
-
-func (cl *CeLogger) getFileSize(path string) (size int64, err error) {
-	fi, err := os.Stat(path)
-	if !(err == nil || os.IsExist(err)) {
-		return 0, err
-	}
-
-	return fi.Size(), nil
-}
-
-func (cl *CeLogger) getNextValidFilename(path string) string {
-	i := 0
-	f, e := cl.getFilenameExt(path)
-	var format string
-	if e == "" {
-		format = "%s_%d%s"
-	} else {
-		format = "%s_%d.%s"
-	}
-
-	for {
-		i++
-		filename := fmt.Sprintf(format, f, i, e)
-		if _, err := os.Stat(filename); os.IsNotExist(err) {
-			return filename
-		}
-	}
-}
-
 func (cl *CeLogger) applyConfig() *CeLogger {
 	cl.SetSeqIndexWidth(cl.SeqIndexWidth)
+	cl.SetTextTemplate(cl.TextTemplate)
 
 	return cl
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"unicode/utf8"
 )
 
 func init() {
@@ -20,15 +21,25 @@ const (
 	ECWarn  = "Warn"
 	ECError = "Error"
 	ECPanic = "Panic"
+	ECFatal = "Fatal"
 )
 
+// Default severity of entry configs, higher is more severe
+var defaultSeverity = map[string]int{ECTrace: 10, ECDebug: 20, ECInfo: 30, ECWarn: 40, ECError: 50, ECPanic: 60, ECFatal: 70}
+
+// Entry configs flushing sinks by default
+var defaultFlush = map[string]bool{ECError: true, ECPanic: true, ECFatal: true}
+
 type EntryConfig struct {
 	Tag            string // e.g. "P" -> "Panic"
 	IsEnable       bool
+	Severity       int  // order for Level threshold, Trace 10 < Debug 20 < Info 30 < Warn 40 < Error 50 < Panic 60 < Fatal 70
 	IsWriteFile    bool // if log to file
 	IsWriteConsole bool // if log to console
 	IsColorFile    bool // if log color in file
 	IsColorConsole bool // if log color in console
+	IsFlush        bool // if flush sinks right after this entry
+	IsStack        bool // if capture stack trace of log call, see StackDepth
 	DisplayMode    uint
 	ForeColor      uint
 	BackColor      uint
@@ -57,16 +68,58 @@ func (ec *EntryConfig) ValidateConfig() *EntryConfig {
 // CeLoggerConfig
 // ----------
 
+// OverflowPolicy, how to treat new log entry when async queue is full
+const (
+	OverflowBlock      = "Block"      // wait until queue has room
+	OverflowDropNewest = "DropNewest" // drop the new entry
+	OverflowDropOldest = "DropOldest" // drop the oldest entry in queue
+)
+
+// RotateTime, time based rotation of log file, or interval like "30m", "6h"
+const (
+	RotateNone   = ""       // no time based rotation
+	RotateHourly = "Hourly" // new log file at every hour, e.g. test_2015_03_04_15.log
+	RotateDaily  = "Daily"  // new log file at midnight, e.g. test_2015_03_04.log
+)
+
+// RotateScheme, how log files are named when MaxFileSize or MaxEntryNum reached
+const (
+	RotateSchemeIncrement = "Increment" // new log file with next free suffix, e.g. test.log, test_1.log, test_2.log
+	RotateSchemeShift     = "Shift"     // logrotate style, current log file keeps name, e.g. test.log, test.log.1, test.log.2
+)
+
+// LevelRule overrides Level for entries of user tag and/or caller package,
+// e.g. {Tag: "HTTP", Level: "Debug"} logs Debug of "HTTP" and "HTTP.GET" while Level is "Warn"
+type LevelRule struct {
+	Tag     string // user tag, child tags by WithTag() included, "" means any
+	Package string // caller package, e.g. "storage" or "github.com/a/storage", sub packages included, "" means any
+	Level   string // min level of matched entries, "" means all
+}
+
 type CeLoggerConfig struct {
-	ChanLen             uint           // Chan buffer len
+	ChanLen             uint           // Chan buffer len, i.e. len of async queue
+	OverflowPolicy      string         // Block/DropNewest/DropOldest when async queue is full
 	MaxFileSize         uint           // max file size of one log file
 	MaxEntryNum         uint           // max entry num in one log file
+	RotateScheme        string         // Increment/Shift, how log files are named when MaxFileSize or MaxEntryNum reached
+	IsAppendOnStart     bool           // if continue the last log file on start until limits reached, instead of a new one
+	RotateTime          string         // time based rotation, ""/Hourly/Daily or interval like "30m", aligned to local midnight
+	RotateFilePattern   string         // time layout of rotated filename, e.g. "log_2006_01_02.log", "" means LogFilePath with time suffix
+	MaxBackups          uint           // max count of rotated log files kept, the oldest are removed, 0 means no limit
+	MaxAge              uint           // max age in hours of rotated log files, 0 means no limit
+	MaxTotalSize        uint           // max total size of current and rotated log files, 0 means no limit
+	IsCompress          bool           // if gzip rotated log files in background, e.g. test_1.log -> test_1.log.gz
 	ContentDelimiter    string         // default is " ", set "\n" will print content at next line
-	IsSyncWriteFile     bool           // sync write file or async by goroutine()
-	IsLogOrderFlag      bool           // if log "X" when out of order, latter will happen when write file async
+	Level               string         // min level to log, e.g. "Warn" logs Warn/Error/Panic only, "" means all, can be set per sink
+	LevelRules          []LevelRule    // Level overrides by user tag or caller package, the most specific matched one is used
+	LogFormat           string         // format of log entry, text/json/logfmt, can be changed per sink
+	TextTemplate        string         // template of text format, e.g. "{time} {level} [{tag}] {caller}: {msg}"
+	IsSyncWriteFile     bool           // sync write sinks or async by a single writer goroutine
+	IsLogOrderFlag      bool           // if log "X" when out of order, only happen when entries dropped since async queue keeps order
 	IsLogSeqIndex       bool           // if log entry index
 	SeqIndexWidth       uint           // width of entry index, e.g. =4 means -> 0001 - 9999
-	IsLogEntryTag       bool           // if log type tag, = T/I/D/W/E/P, means Trace/Info/Debug/Warn/Error/Panic
+	IsContinueSeqIndex  bool           // if continue entry index after SetEnable(false) and SetEnable(true), instead of reset to 1
+	IsLogEntryTag       bool           // if log type tag, = T/I/D/W/E/P/F, means Trace/Info/Debug/Warn/Error/Panic/Fatal
 	IsLogFuncEnterExit  bool           // if log func enter/exit
 	IsLogCodeFilename   bool           // if log current filename in code
 	IsLogCodeLineNumber bool           // if log current line number in code
@@ -74,24 +127,47 @@ type CeLoggerConfig struct {
 	IsLogDate           bool           // if log date, e.g. 2015-03-04
 	IsLogTime           bool           // if log time, e.g. 12:34.23456
 	TimeMsWidth         uint           // width of ms width, e.g. =4 means time -> 12:34.1231
-	IsLogColor          bool           // if colorize content
-	IsWriteFile         bool           // if log to file
-	IsWriteConsole      bool           // if log to console
+	IsLogColor          bool           // if colorize content, also need EntryConfig.IsColorFile/IsColorConsole
+	IsWriteFile         bool           // if log to file, also need EntryConfig.IsWriteFile
+	IsWriteConsole      bool           // if log to console, also need EntryConfig.IsWriteConsole
 	LogFilePath         string         // log filename
-	ECMap               EntryConfigMap // store all log type info, e.g. Trace/Info/Debug/Warn/Error/Panic
+	IsReopenOnSighup    bool           // if reopen log files on SIGHUP, for logrotate with create or copytruncate
+	CurrentLinkPath     string         // symlink always pointing to current log file, e.g. "app.current.log", "" means no link
+	IsSessionFile       bool           // if also write each session to its own file, e.g. test_<name>_<id>.log, ignored if not IsWriteFile
+	FileBufferSize      uint           // buffer size of log file writer, 0 means flush every entry
+	FlushInterval       uint           // interval in ms to flush sinks, 0 means no periodic flush
+	IsPanicLogOnly      bool           // if Panic() only logs like old versions, instead of flush and panic
+	StackDepth          uint           // max frames of stack trace, for EntryConfig.IsStack
+	ErrorDedupWindow    uint           // window in ms to log identical errors of ErrorE() once with a repeated count, 0 means no dedup
+	ECMap               EntryConfigMap // store all log type info, e.g. Trace/Info/Debug/Warn/Error/Panic/Fatal
+
+	textTemplate []templateSegment // compiled TextTemplate, nil means default bracketed text
 }
 
 func NewCeLoggerConfig() *CeLoggerConfig {
 	c := &CeLoggerConfig{}
 
-	c.ChanLen = 1024                // 1K
+	c.ChanLen = 1024 // 1K
+	c.OverflowPolicy = OverflowBlock
 	c.MaxFileSize = 1 * 1024 * 1024 // 1MB
 	c.MaxEntryNum = 10 * 1024       // 10K
-	c.ContentDelimiter = " "        // "\n" -> put content to new line
-	c.IsSyncWriteFile = true        // Sync write file is safe and in order
-	c.IsLogOrderFlag = false        // Only need when async write file
-	c.IsLogSeqIndex = true          // Entry index
-	c.SeqIndexWidth = 4             // Entry index just like "0023"
+	c.RotateScheme = RotateSchemeIncrement
+	c.IsAppendOnStart = false
+	c.RotateTime = RotateNone
+	c.RotateFilePattern = ""
+	c.MaxBackups = 0 // keep all rotated log files
+	c.MaxAge = 0
+	c.MaxTotalSize = 0
+	c.IsCompress = false
+	c.ContentDelimiter = " " // "\n" -> put content to new line
+	c.Level = ""             // all levels, see EntryConfig.IsEnable too
+	c.LogFormat = LogFormatText
+	c.TextTemplate = ""          // default bracketed text
+	c.IsSyncWriteFile = true     // Sync write file is safe and in order
+	c.IsLogOrderFlag = false     // Only need when async write file
+	c.IsLogSeqIndex = true       // Entry index
+	c.SeqIndexWidth = 4          // Entry index just like "0023"
+	c.IsContinueSeqIndex = false // Entry index start from 1 once log enabled
 	c.IsLogFuncEnterExit = true
 	c.IsLogCodeFilename = false
 	c.IsLogCodeLineNumber = false
@@ -104,6 +180,14 @@ func NewCeLoggerConfig() *CeLoggerConfig {
 	c.IsWriteConsole = true
 	c.IsLogEntryTag = true
 	c.LogFilePath = ""
+	c.IsReopenOnSighup = false
+	c.CurrentLinkPath = ""
+	c.IsSessionFile = false
+	c.FileBufferSize = 4 * 1024 // 4KB
+	c.FlushInterval = 1000      // 1s
+	c.IsPanicLogOnly = false    // Panic() flushes and panics
+	c.StackDepth = 32
+	c.ErrorDedupWindow = 1000 // 1s
 
 	c.ECMap = make(EntryConfigMap)
 	c.ECMap[""] = &EntryConfig{Tag: "", DisplayMode: 0, ForeColor: 33, BackColor: 0}
@@ -113,15 +197,18 @@ func NewCeLoggerConfig() *CeLoggerConfig {
 	c.ECMap[ECWarn] = &EntryConfig{Tag: "W", DisplayMode: 1, ForeColor: 31, BackColor: 43}
 	c.ECMap[ECError] = &EntryConfig{Tag: "E", DisplayMode: 1, ForeColor: 37, BackColor: 41}
 	c.ECMap[ECPanic] = &EntryConfig{Tag: "P", DisplayMode: 1, ForeColor: 33, BackColor: 41}
+	c.ECMap[ECFatal] = &EntryConfig{Tag: "F", DisplayMode: 1, ForeColor: 37, BackColor: 45}
 
-	for _, ec := range c.ECMap {
+	for name, ec := range c.ECMap {
+		ec.Severity = defaultSeverity[name]
 		ec.IsEnable = true
 		ec.IsColorConsole = true
 		ec.IsColorFile = false
 		ec.IsWriteConsole = true
 		ec.IsWriteFile = true
+		ec.IsFlush = defaultFlush[name]
 	}
-    
+
 	return c
 }
 
@@ -132,6 +219,17 @@ func (c *CeLoggerConfig) UpdateConfigByJson(js string) error {
 		return err
 	}
 
+	// Config saved by old version has no IsFlush, default one is used then
+	var saved struct {
+		ECMap map[string]map[string]json.RawMessage
+	}
+	json.Unmarshal([]byte(js), &saved)
+	for name, fields := range saved.ECMap {
+		if _, ok := fields["IsFlush"]; !ok && c.ECMap[name] != nil {
+			c.ECMap[name].IsFlush = defaultFlush[name]
+		}
+	}
+
 	c.ValidateConfig()
 
 	return nil
@@ -174,12 +272,54 @@ func (c *CeLoggerConfig) SetEntryConfig(name string, ec *EntryConfig) *EntryConf
 	return ec
 }
 
+// Register custom level to be logged by Log()/Logf()/LogW(), e.g. "Audit", "Notice".
+// Default entry config with first letter as tag is used if ec is nil.
+// Register before SetEnable(true), since ECMap is not locked for logging
+func (c *CeLoggerConfig) RegisterLevel(name string, severity int, ec *EntryConfig) *EntryConfig {
+	if name == "" {
+		fmt.Println("Register level failed, empty name")
+		return nil
+	}
+
+	if ec == nil {
+		_, n := utf8.DecodeRuneInString(name)
+		ec = &EntryConfig{Tag: name[:n], IsEnable: true, IsWriteFile: true, IsWriteConsole: true, IsColorConsole: true}
+	}
+	ec.Severity = severity
+	ec.ValidateConfig()
+
+	return c.SetEntryConfig(name, ec)
+}
+
 // Validate config data
 func (c *CeLoggerConfig) ValidateConfig() *CeLoggerConfig {
 	if c.ChanLen == 0 {
 		c.ChanLen = 1024
 	}
 
+	switch c.LogFormat {
+	case LogFormatText, LogFormatJson, LogFormatLogfmt:
+	default:
+		c.LogFormat = LogFormatText
+	}
+
+	switch c.OverflowPolicy {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+	default:
+		c.OverflowPolicy = OverflowBlock
+	}
+
+	switch c.RotateScheme {
+	case RotateSchemeIncrement, RotateSchemeShift:
+	default:
+		c.RotateScheme = RotateSchemeIncrement
+	}
+
+	if _, err := parseRotateTime(c.RotateTime); err != nil {
+		fmt.Printf("Invalid RotateTime [%s], time based rotation is disabled: %s\n", c.RotateTime, err.Error())
+		c.RotateTime = RotateNone
+	}
+
 	if c.SeqIndexWidth > 8 {
 		c.SeqIndexWidth = 8
 	}
@@ -188,8 +328,38 @@ func (c *CeLoggerConfig) ValidateConfig() *CeLoggerConfig {
 		c.TimeMsWidth = 9
 	}
 
-	for _, ec := range c.ECMap {
+	for name, ec := range c.ECMap {
+		// Config saved by old version has no severity
+		if ec.Severity == 0 {
+			ec.Severity = defaultSeverity[name]
+		}
 		ec.ValidateConfig()
 	}
+
+	if _, ok := c.ECMap[c.Level]; c.Level != "" && !ok {
+		fmt.Printf("Unknown Level [%s], all levels are logged\n", c.Level)
+		c.Level = ""
+	}
+
+	rules := c.LevelRules[:0]
+	for _, r := range c.LevelRules {
+		if _, ok := c.ECMap[r.Level]; r.Level != "" && !ok {
+			fmt.Printf("Unknown Level [%s] of level rule, rule is ignored\n", r.Level)
+			continue
+		}
+		rules = append(rules, r)
+	}
+	c.LevelRules = rules
+
 	return c
 }
+
+// If entry of ec is not below level, "" means all levels
+func (c *CeLoggerConfig) isAboveLevel(level string, ec *EntryConfig) bool {
+	if level == "" || ec == nil {
+		return true
+	}
+
+	lc, ok := c.ECMap[level]
+	return !ok || ec.Severity >= lc.Severity
+}
@@ -58,4 +58,39 @@ func TestUpdateConfig(t *testing.T) {
 	if c1.SeqIndexWidth != 3 || c1.IsLogCodeFilename != false {
 		t.Error("update config with json failed")
 	}
+
+	t.Log("Test update config saved by old version")
+	c2 := NewCeLoggerConfig()
+	c2.UpdateConfigByJson(`{"ECMap":{"Error":{"Tag":"E","IsEnable":true},"Info":{"Tag":"I","IsEnable":true},"Warn":{"Tag":"W","IsFlush":true}}}`)
+	if ec := c2.ECMap[ECError]; !ec.IsFlush || ec.Severity != 50 {
+		t.Errorf("default of Error not kept %v", ec)
+	}
+	if c2.ECMap[ECInfo].IsFlush || !c2.ECMap[ECWarn].IsFlush {
+		t.Error("IsFlush of Info or Warn is wrong")
+	}
+}
+
+func TestLevelConfig(t *testing.T) {
+	c1 := NewCeLoggerConfig()
+
+	t.Log("Test level config")
+
+	if err := c1.UpdateConfigByJson(`{"Level":"Warn","ECMap":{"Info":{"Tag":"I","IsEnable":true}}}`); err != nil {
+		t.Error(err)
+	}
+	if c1.Level != ECWarn || c1.ECMap[ECInfo].Severity != 30 {
+		t.Errorf("level config failed, Level %s, Info severity %d", c1.Level, c1.ECMap[ECInfo].Severity)
+	}
+	if c1.isAboveLevel(c1.Level, c1.ECMap[ECInfo]) || !c1.isAboveLevel(c1.Level, c1.ECMap[ECError]) {
+		t.Error("wrong severity order")
+	}
+
+	if c1.UpdateConfigByJson(`{"Level":"Unknown"}`); c1.Level != "" {
+		t.Error("unknown level is used")
+	}
+
+	js := `{"LevelRules":[{"Tag":"HTTP","Level":"Debug"},{"Package":"storage","Level":"Unknown"}]}`
+	if c1.UpdateConfigByJson(js); len(c1.LevelRules) != 1 || c1.LevelRules[0].Tag != "HTTP" {
+		t.Errorf("wrong level rules %v", c1.LevelRules)
+	}
 }
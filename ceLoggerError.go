@@ -0,0 +1,196 @@
+package ceLogger
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// ----------
+// Error
+// ----------
+
+// Max errors walked in chain of one error, in case of cyclic Unwrap(), e.g. Unwrap() returns itself
+const maxErrorCauses = 32
+
+// Causes of err by Unwrap() chain, depth first for errors joined by errors.Join(),
+// pkg/errors style Cause() is also supported.
+// Cause with the same message as its wrapper is skipped, e.g. errors.WithStack(io.EOF)
+func getErrorCauses(err error) []error {
+	var causes []error
+	walked := 0
+
+	var walk func(e error, msg string)
+	walk = func(e error, msg string) {
+		var next []error
+		switch x := e.(type) {
+		case interface{ Unwrap() error }:
+			next = []error{x.Unwrap()}
+		case interface{ Unwrap() []error }:
+			next = x.Unwrap()
+		case interface{ Cause() error }:
+			next = []error{x.Cause()}
+		}
+
+		for _, cause := range next {
+			if cause == nil || walked >= maxErrorCauses {
+				continue
+			}
+			walked++
+
+			s := cause.Error()
+			if s != msg {
+				causes = append(causes, cause)
+			}
+			walk(cause, s)
+		}
+	}
+	walk(err, err.Error())
+
+	return causes
+}
+
+// Fields of error causes, e.g. cause1="open a.json: no such file" cause2="no such file"
+func (c *CeLoggerConfig) getErrorFields(err error) []Field {
+	causes := getErrorCauses(err)
+
+	fields := make([]Field, len(causes))
+	for i, cause := range causes {
+		fields[i] = Field{"cause" + strconv.Itoa(i+1), cause.Error()}
+	}
+	return fields
+}
+
+// Stack trace carried by the deepest error in chain of err, nil if none.
+// An error exposes stack trace by method StackTrace() or Callers() returning program counters,
+// e.g. StackTrace() of github.com/pkg/errors, Callers() of github.com/go-errors/errors
+func (cl *CeLogger) getErrorStack(err error) []StackFrame {
+	if cl.StackDepth == 0 {
+		return nil
+	}
+
+	var pcs []uintptr
+	for _, e := range append([]error{err}, getErrorCauses(err)...) {
+		if p := getErrorPCs(e); len(p) > 0 {
+			pcs = p
+		}
+	}
+	return cl.getStackFrames(pcs, 0)
+}
+
+// Program counters of error stack trace, by reflect since the method returns its own type,
+// e.g. errors.StackTrace which is []errors.Frame of uintptr
+func getErrorPCs(err error) []uintptr {
+	v := reflect.ValueOf(err)
+	for _, name := range []string{"StackTrace", "Callers"} {
+		m := v.MethodByName(name)
+		if !m.IsValid() || m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+			continue
+		}
+		t := m.Type().Out(0)
+		if t.Kind() != reflect.Slice || t.Elem().Kind() != reflect.Uintptr {
+			continue
+		}
+
+		out := m.Call(nil)[0]
+		pcs := make([]uintptr, out.Len())
+		for i := range pcs {
+			pcs[i] = uintptr(out.Index(i).Uint())
+		}
+		return pcs
+	}
+	return nil
+}
+
+// ----------
+// Dedup
+// ----------
+
+// Error logged by ErrorE(), identical ones in dedup window are counted instead of logged
+type errorRecord struct {
+	entry *LogEntry   // the logged one, nil until written
+	count uint        // repeated count in window
+	timer *time.Timer // ends window
+}
+
+// Start dedup window of error by key, nil if it is repeated in current window.
+// Window is not started if ErrorDedupWindow is 0, but a record is still returned
+func (cl *CeLogger) startErrorWindow(key string) *errorRecord {
+	window := time.Duration(cl.ErrorDedupWindow) * time.Millisecond
+	if window == 0 {
+		return &errorRecord{}
+	}
+
+	cl.errorMutex.Lock()
+	defer cl.errorMutex.Unlock()
+
+	if rec, ok := cl.errorRecords[key]; ok {
+		rec.count++
+		return nil
+	}
+
+	if cl.errorRecords == nil {
+		cl.errorRecords = make(map[string]*errorRecord)
+	}
+	rec := &errorRecord{}
+	rec.timer = time.AfterFunc(window, func() {
+		cl.endErrorWindow(key, rec)
+	})
+	cl.errorRecords[key] = rec
+	return rec
+}
+
+// Set logged entry of record, for summary when window ends
+func (cl *CeLogger) setErrorEntry(rec *errorRecord, entry *LogEntry) {
+	cl.errorMutex.Lock()
+	defer cl.errorMutex.Unlock()
+
+	rec.entry = entry
+}
+
+// End dedup window of record, write summary if error repeated
+func (cl *CeLogger) endErrorWindow(key string, rec *errorRecord) {
+	cl.errorMutex.Lock()
+	if cl.errorRecords[key] != rec {
+		// Ended by endErrorWindows() already
+		cl.errorMutex.Unlock()
+		return
+	}
+	delete(cl.errorRecords, key)
+	cl.errorMutex.Unlock()
+
+	cl.writeErrorSummary(rec)
+}
+
+// End all dedup windows at once, e.g. before log stopped
+func (cl *CeLogger) endErrorWindows() {
+	cl.errorMutex.Lock()
+	recs := cl.errorRecords
+	cl.errorRecords = nil
+	cl.errorMutex.Unlock()
+
+	for _, rec := range recs {
+		rec.timer.Stop()
+		cl.writeErrorSummary(rec)
+	}
+}
+
+// Write summary of repeated error, e.g. "open a.json: no such file (repeated 3 times)",
+// caller and fields are the same as the logged one
+func (cl *CeLogger) writeErrorSummary(rec *errorRecord) {
+	cl.errorMutex.Lock()
+	entry, count := rec.entry, rec.count
+	cl.errorMutex.Unlock()
+
+	if entry == nil || count == 0 {
+		return
+	}
+
+	summary := *entry
+	summary.Time = time.Now()
+	summary.Index = 0
+	summary.Content = fmt.Sprintf("%s (repeated %d times)", entry.Content, count)
+	summary.Stack = nil
+	cl.writeEntry(&summary)
+}
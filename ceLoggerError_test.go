@@ -0,0 +1,132 @@
+package ceLogger
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Error with stack trace like github.com/pkg/errors
+type frame uintptr
+
+type stackError struct {
+	error
+	pcs []uintptr
+}
+
+func (e *stackError) StackTrace() []frame {
+	frames := make([]frame, len(e.pcs))
+	for i, pc := range e.pcs {
+		frames[i] = frame(pc)
+	}
+	return frames
+}
+
+func (e *stackError) Unwrap() error {
+	return e.error
+}
+
+// Error whose Unwrap() returns itself
+type cyclicError struct{}
+
+func (e *cyclicError) Error() string { return "cyclic" }
+func (e *cyclicError) Unwrap() error { return e }
+
+func newStackError(err error) error {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(2, pcs)
+	return &stackError{err, pcs[:n]}
+}
+
+func TestErrorE(t *testing.T) {
+	l := NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false).SetLogTime(false).SetLogCodeFuncName(false).SetLogColor(false)
+	s := &memorySink{}
+	l.AddSink(s)
+	l.SetErrorDedupWindow(0)
+
+	l.SetEnable(true)
+	l.ErrorE("Config", nil)
+
+	t.Log("Wrapped chain")
+	err := fmt.Errorf("load config: %w", fmt.Errorf("read a.json: %w", io.ErrUnexpectedEOF))
+	l.ErrorE("Config", err, "retry", 3)
+
+	t.Log("Joined errors")
+	l.ErrorE("Config", errors.Join(io.EOF, fmt.Errorf("close: %w", io.ErrClosedPipe)))
+
+	t.Log("Error with stack trace")
+	l.ErrorE("Config", fmt.Errorf("load config: %w", newStackError(io.EOF)))
+
+	t.Log("Cyclic Unwrap()")
+	l.ErrorE("Config", &cyclicError{})
+	l.SetEnable(false)
+
+	if s.count() != 4 {
+		t.Fatalf("%d entries, want 4", s.count())
+	}
+
+	e := s.entries[0]
+	text := string(l.FormatEntry(LogFormatText, e, false))
+	if want := `[0001] [E][Config]load config: read a.json: unexpected EOF retry=3 cause1="read a.json: unexpected EOF" cause2="unexpected EOF"`; text != want {
+		t.Errorf("text is %s, want %s", text, want)
+	}
+	if e.Stack != nil {
+		t.Errorf("stack of error without stack trace %v", e.Stack)
+	}
+
+	e = s.entries[1]
+	if len(e.Fields) != 3 || e.Fields[0] != (Field{"cause1", "EOF"}) ||
+		e.Fields[1] != (Field{"cause2", "close: io: read/write on closed pipe"}) || e.Fields[2] != (Field{"cause3", "io: read/write on closed pipe"}) {
+		t.Errorf("wrong causes of joined errors %v", e.Fields)
+	}
+
+	e = s.entries[2]
+	if len(e.Fields) != 1 || e.Fields[0] != (Field{"cause1", "EOF"}) {
+		t.Errorf("wrong causes of error with stack trace %v", e.Fields)
+	}
+	if len(e.Stack) == 0 || !strings.HasSuffix(e.Stack[0].Func, ".TestErrorE") || !strings.HasSuffix(e.Stack[0].File, "ceLoggerError_test.go") {
+		t.Errorf("wrong stack %v", e.Stack)
+	}
+
+	if e = s.entries[3]; e.Content != "cyclic" || len(e.Fields) != 0 {
+		t.Errorf("wrong entry of cyclic error %s %v", e.Content, e.Fields)
+	}
+}
+
+func TestErrorDedup(t *testing.T) {
+	l := NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false).SetLogTime(false).SetLogCodeFuncName(false).SetLogColor(false)
+	s := &memorySink{}
+	l.AddSink(s)
+	l.SetErrorDedupWindow(100)
+
+	l.SetEnable(true)
+	for i := 0; i < 5; i++ {
+		l.ErrorE("Dedup", io.EOF)
+	}
+	l.ErrorE("Other", io.EOF)
+	l.ErrorE("Dedup", io.ErrUnexpectedEOF)
+
+	t.Log("Window ends")
+	time.Sleep(300 * time.Millisecond)
+	l.ErrorE("Dedup", io.EOF)
+
+	t.Log("Log stopped in window")
+	l.ErrorE("Dedup", io.EOF)
+	l.ErrorE("Dedup", io.EOF)
+	l.SetEnable(false)
+
+	want := []string{"EOF", "EOF", "unexpected EOF", "EOF (repeated 4 times)", "EOF", "EOF (repeated 2 times)"}
+	contents := s.contents()
+	if strings.Join(contents, "|") != strings.Join(want, "|") {
+		t.Fatalf("contents are %q, want %q", contents, want)
+	}
+	if e := s.entries[3]; e.Tag != "Dedup" || e.Level != ECError || e.Index != 4 {
+		t.Errorf("wrong summary %v", e)
+	}
+}
@@ -0,0 +1,42 @@
+package ceLogger
+
+// ----------
+// Field
+// ----------
+
+// Field is a key/value pair carried by log entry,
+// rendered as key=value in text and logfmt, as object member in json
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func NewField(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Convert keyvals to fields, keyvals can be Field or key, value pairs,
+// e.g. "user", id, NewField("latency", d)
+func (c *CeLoggerConfig) getFields(keyvals []interface{}) []Field {
+	if len(keyvals) == 0 {
+		return nil
+	}
+
+	fields := make([]Field, 0, len(keyvals))
+	for i := 0; i < len(keyvals); i++ {
+		if f, ok := keyvals[i].(Field); ok {
+			fields = append(fields, f)
+			continue
+		}
+
+		// Value of the last key is missing
+		if i == len(keyvals)-1 {
+			fields = append(fields, Field{Key: c.getString(keyvals[i])})
+			break
+		}
+
+		fields = append(fields, Field{Key: c.getString(keyvals[i]), Value: keyvals[i+1]})
+		i++
+	}
+	return fields
+}
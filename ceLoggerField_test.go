@@ -0,0 +1,85 @@
+package ceLogger
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetFields(t *testing.T) {
+	c := NewCeLoggerConfig()
+
+	fields := c.getFields([]interface{}{"user", 12, NewField("latency", time.Second), "missing"})
+	want := []Field{{"user", 12}, {"latency", time.Second}, {"missing", nil}}
+	if len(fields) != len(want) {
+		t.Fatalf("got %d fields, want %d", len(fields), len(want))
+	}
+	for i := range want {
+		if fields[i] != want[i] {
+			t.Errorf("field %d is %v, want %v", i, fields[i], want[i])
+		}
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	l := NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false).SetLogTime(false).SetLogCodeFuncName(false).SetLogColor(false)
+	s := &memorySink{}
+	l.AddSink(s)
+
+	l.SetEnable(true)
+	l.InfoW("HTTP", "request done", "user", 12, "path", "/a b", "err", errors.New("EOF"))
+	l.SetEnable(false)
+
+	if s.count() != 1 || len(s.entries[0].Fields) != 3 {
+		t.Fatal("fields not logged")
+	}
+	e := s.entries[0]
+
+	t.Log("Text format")
+	text := string(l.FormatEntry(LogFormatText, e, false))
+	if want := `[0001] [I][HTTP]request done user=12 path="/a b" err=EOF`; text != want {
+		t.Errorf("text is %s, want %s", text, want)
+	}
+
+	t.Log("Logfmt format")
+	logfmt := string(l.FormatEntry(LogFormatLogfmt, e, false))
+	if !strings.HasSuffix(logfmt, `msg="request done" user=12 path="/a b" err=EOF`) {
+		t.Errorf("wrong logfmt %s", logfmt)
+	}
+
+	t.Log("Json format")
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(l.FormatEntry(LogFormatJson, e, false), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["user"] != 12.0 || m["path"] != "/a b" || m["err"] != "EOF" {
+		t.Errorf("wrong json fields %v", m)
+	}
+
+	t.Log("Text template")
+	l.SetTextTemplate("{msg} | {fields}")
+	if text := string(l.FormatEntry(LogFormatText, e, false)); text != `request done | user=12 path="/a b" err=EOF` {
+		t.Errorf("wrong text with template %s", text)
+	}
+	l.SetTextTemplate("{msg}")
+	if text := string(l.FormatEntry(LogFormatText, e, false)); text != `request done user=12 path="/a b" err=EOF` {
+		t.Errorf("wrong text with template %s", text)
+	}
+
+	t.Log("Json format with field keys of entry")
+	l.SetEnable(true)
+	l.InfoW("HTTP", "real", "msg", "override", "level", "x", "seq", 0)
+	l.SetEnable(false)
+	js := string(l.FormatEntry(LogFormatJson, s.entries[1], false))
+	if strings.Count(js, `"msg":`) != 1 || strings.Count(js, `"level":`) != 1 {
+		t.Errorf("duplicate json keys %s", js)
+	}
+	m = make(map[string]interface{})
+	json.Unmarshal([]byte(js), &m)
+	if m["msg"] != "real" || m["level"] != ECInfo || m["fields.msg"] != "override" || m["fields.level"] != "x" || m["fields.seq"] != 0.0 {
+		t.Errorf("wrong json %s", js)
+	}
+}
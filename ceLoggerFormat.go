@@ -0,0 +1,390 @@
+package ceLogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ----------
+// Format
+// ----------
+
+const (
+	LogFormatText   = "text"   // e.g. [0012][15:16:17.1234](main.test) [I][HTTP]content
+	LogFormatJson   = "json"   // one json object per line
+	LogFormatLogfmt = "logfmt" // e.g. seq=12 time=15:16:17.1234 func=main.test level=Info tag=HTTP msg=content
+)
+
+// Format log entry by format, tag and content are colorized if isColor and format supports
+func (c *CeLoggerConfig) FormatEntry(format string, entry *LogEntry, isColor bool) []byte {
+	switch format {
+	case LogFormatJson:
+		return c.FormatJson(entry)
+	case LogFormatLogfmt:
+		return c.FormatLogfmt(entry)
+	default:
+		return c.FormatText(entry, isColor)
+	}
+}
+
+// Format of sink, LogFormat if sink format is empty
+func (c *CeLoggerConfig) getFormat(format string) string {
+	if format == "" {
+		return c.LogFormat
+	}
+	return format
+}
+
+// Keys of json format, field with the same key is renamed, e.g. "msg" -> "fields.msg"
+var jsonKeys = map[string]bool{
+	"seq": true, "timestamp": true, "level": true, "level_tag": true, "tag": true,
+	"file": true, "line": true, "func": true, "msg": true, "stack": true,
+}
+
+// Json of log entry, empty field is omitted
+// e.g. {"seq":12,"timestamp":"2015-03-04T15:16:17.1234+08:00","level":"Info","level_tag":"I","tag":"HTTP","func":"main.test","msg":"content"}
+func (c *CeLoggerConfig) FormatJson(entry *LogEntry) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("{")
+
+	if entry.Index > 0 {
+		c.writeJsonField(&buf, "seq", entry.Index)
+	}
+	c.writeJsonField(&buf, "timestamp", entry.Time.Format(time.RFC3339Nano))
+	if entry.ec != nil {
+		c.writeJsonField(&buf, "level", entry.Level)
+		c.writeJsonField(&buf, "level_tag", entry.ec.Tag)
+		c.writeJsonField(&buf, "tag", entry.Tag)
+	}
+	if entry.File != "" {
+		c.writeJsonField(&buf, "file", entry.File)
+		c.writeJsonField(&buf, "line", entry.Line)
+	}
+	if entry.Func != "" {
+		c.writeJsonField(&buf, "func", entry.Func)
+	}
+	c.writeJsonField(&buf, "msg", entry.Content)
+	for _, f := range entry.Fields {
+		key := f.Key
+		if jsonKeys[key] {
+			key = "fields." + key
+		}
+		if err, ok := f.Value.(error); ok {
+			c.writeJsonField(&buf, key, err.Error())
+		} else {
+			c.writeJsonField(&buf, key, f.Value)
+		}
+	}
+	if len(entry.Stack) > 0 {
+		c.writeJsonField(&buf, "stack", c.getStackStrings(entry.Stack))
+	}
+
+	buf.WriteString("}")
+
+	return buf.Bytes()
+}
+
+// Write "key":value to json object in buf
+func (c *CeLoggerConfig) writeJsonField(buf *bytes.Buffer, key string, value interface{}) {
+	if buf.Len() > 1 {
+		buf.WriteString(",")
+	}
+
+	buf.Write(c.getJsonBytes(key))
+	buf.WriteString(":")
+	buf.Write(c.getJsonBytes(value))
+}
+
+// Json of value without html escape, use "%v" string if value can not be marshaled
+func (c *CeLoggerConfig) getJsonBytes(value interface{}) []byte {
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		buf.Reset()
+		encoder.Encode(fmt.Sprintf("%v", value))
+	}
+
+	// Remove "\n" appended by Encode()
+	return bytes.TrimRight(buf.Bytes(), "\n")
+}
+
+// Logfmt of log entry, fields are the same as text format
+// e.g. seq=12 date=2015-03-04 time=15:16:17.1234 file=abc.go line=12 func=main.test level=Info tag=HTTP msg="some content"
+func (c *CeLoggerConfig) FormatLogfmt(entry *LogEntry) []byte {
+	var buf bytes.Buffer
+
+	if c.IsLogSeqIndex && entry.Index > 0 {
+		c.writeLogfmtField(&buf, "seq", strconv.Itoa(int(entry.Index)))
+	}
+	if c.IsLogDate {
+		c.writeLogfmtField(&buf, "date", entry.Time.Format("2006-01-02"))
+	}
+	if c.IsLogTime {
+		c.writeLogfmtField(&buf, "time", c.getTimeString(entry.Time))
+	}
+	if c.IsLogCodeFilename && entry.File != "" {
+		c.writeLogfmtField(&buf, "file", entry.File)
+		if c.IsLogCodeLineNumber {
+			c.writeLogfmtField(&buf, "line", strconv.Itoa(entry.Line))
+		}
+	}
+	if c.IsLogCodeFuncName && entry.Func != "" {
+		c.writeLogfmtField(&buf, "func", entry.Func)
+	}
+	if entry.ec != nil {
+		if c.IsLogEntryTag {
+			c.writeLogfmtField(&buf, "level", entry.Level)
+		}
+		c.writeLogfmtField(&buf, "tag", entry.Tag)
+	}
+	c.writeLogfmtField(&buf, "msg", entry.Content)
+	for _, f := range entry.Fields {
+		c.writeLogfmtField(&buf, f.Key, c.getString(f.Value))
+	}
+	if len(entry.Stack) > 0 {
+		// One frame per line in quoted value
+		c.writeLogfmtField(&buf, "stack", strings.Join(c.getStackStrings(entry.Stack), "\n"))
+	}
+
+	return buf.Bytes()
+}
+
+// Fields string in text format, e.g. ` user=12 latency=1.5s`
+func (c *CeLoggerConfig) getFieldsString(fields []Field) string {
+	if len(fields) == 0 {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	for _, f := range fields {
+		c.writeLogfmtField(&buf, f.Key, c.getString(f.Value))
+	}
+	return " " + buf.String()
+}
+
+// Write key=value to buf, quote value if necessary
+func (c *CeLoggerConfig) writeLogfmtField(buf *bytes.Buffer, key, value string) {
+	if buf.Len() > 0 {
+		buf.WriteString(" ")
+	}
+
+	buf.WriteString(getLogfmtKey(key))
+	buf.WriteString("=")
+
+	// Quote empty value, or value with space, '=', '"' or control characters
+	if value == "" || strings.IndexFunc(value, isLogfmtUnsafe) >= 0 {
+		buf.WriteString(strconv.Quote(value))
+	} else {
+		buf.WriteString(value)
+	}
+}
+
+// Key with unsafe characters replaced by '_', since key can not be quoted, e.g. "my key" -> "my_key", "" -> "_"
+func getLogfmtKey(key string) string {
+	if key == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if isLogfmtUnsafe(r) {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// Space, '=', '"' or control characters, which break key=value
+func isLogfmtUnsafe(r rune) bool {
+	return r == '=' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r)
+}
+
+// ----------
+// Text template
+// ----------
+
+// Fields can be used in text template, e.g. "{time} {level:-5} [{tag}] {caller}: {msg}"
+//
+//	{seq}      seq index, e.g. 0012
+//	{date}     e.g. 2015-03-04
+//	{time}     e.g. 15:16:17.1234
+//	{level}    entry config name, e.g. Info
+//	{leveltag} entry config tag, e.g. I
+//	{tag}      user tag, e.g. HTTP
+//	{file}     filename in code, e.g. abc.go
+//	{line}     line number in code, e.g. 12
+//	{func}     func name in code, e.g. main.test
+//	{caller}   e.g. abc.go:12-main.test
+//	{msg}      log content
+//	{fields}   key/value fields, e.g. user=12 latency=1.5s, appended to the end if not in template
+//
+// {field:N} pads field to width N, right aligned, {field:-N} left aligned.
+// "{{" and "}}" are literal "{" and "}"
+var templateFields = map[string]bool{
+	"seq": true, "date": true, "time": true, "level": true, "leveltag": true, "tag": true,
+	"file": true, "line": true, "func": true, "caller": true, "msg": true, "fields": true,
+}
+
+// One piece of text template, literal text or field
+type templateSegment struct {
+	text    string // literal text, or field name if isField
+	isField bool
+	width   int // pad field to width, left aligned if negative
+}
+
+// Compile tmpl to be used by text format, empty tmpl means default bracketed text
+func (c *CeLoggerConfig) CompileTextTemplate(tmpl string) error {
+	c.TextTemplate = tmpl
+	c.textTemplate = nil
+
+	if tmpl == "" {
+		return nil
+	}
+
+	segments, err := parseTextTemplate(tmpl)
+	if err != nil {
+		return err
+	}
+	c.textTemplate = segments
+
+	return nil
+}
+
+func parseTextTemplate(tmpl string) ([]templateSegment, error) {
+	var segments []templateSegment
+	var text bytes.Buffer
+
+	for i := 0; i < len(tmpl); i++ {
+		ch := tmpl[i]
+
+		switch {
+		case ch == '{' && i+1 < len(tmpl) && tmpl[i+1] == '{',
+			ch == '}' && i+1 < len(tmpl) && tmpl[i+1] == '}':
+			text.WriteByte(ch)
+			i++
+		case ch == '{':
+			n := strings.IndexByte(tmpl[i:], '}')
+			if n < 0 {
+				return nil, errors.New("unclosed '{' at " + strconv.Itoa(i))
+			}
+
+			name, width := tmpl[i+1:i+n], 0
+			if k := strings.IndexByte(name, ':'); k >= 0 {
+				w, err := strconv.Atoi(name[k+1:])
+				if err != nil {
+					return nil, fmt.Errorf("invalid width of {%s}", name)
+				}
+				name, width = name[:k], w
+			}
+			if !templateFields[name] {
+				return nil, fmt.Errorf("unknown field {%s}", name)
+			}
+
+			if text.Len() > 0 {
+				segments = append(segments, templateSegment{text: text.String()})
+				text.Reset()
+			}
+			segments = append(segments, templateSegment{text: name, isField: true, width: width})
+			i += n
+		case ch == '}':
+			return nil, errors.New("unexpected '}' at " + strconv.Itoa(i))
+		default:
+			text.WriteByte(ch)
+		}
+	}
+
+	if text.Len() > 0 {
+		segments = append(segments, templateSegment{text: text.String()})
+	}
+
+	return segments, nil
+}
+
+// Text of log entry by compiled template, the whole line is colorized if isColor
+func (c *CeLoggerConfig) formatTextTemplate(entry *LogEntry, isColor bool) []byte {
+	var buf bytes.Buffer
+
+	hasFields := false
+	for _, seg := range c.textTemplate {
+		if !seg.isField {
+			buf.WriteString(seg.text)
+			continue
+		}
+		if seg.text == "fields" {
+			hasFields = true
+		}
+
+		s := c.getTemplateField(entry, seg.text)
+		if seg.width != 0 {
+			s = fmt.Sprintf("%*s", seg.width, s)
+		}
+		buf.WriteString(s)
+	}
+
+	if !hasFields {
+		buf.WriteString(c.getFieldsString(entry.Fields))
+	}
+
+	s := buf.String()
+	if isColor && entry.ec != nil {
+		s = c.GetColorString(s, entry.ec)
+	}
+	return []byte(s + c.getStackString(entry.Stack))
+}
+
+// Value of template field
+func (c *CeLoggerConfig) getTemplateField(entry *LogEntry, name string) string {
+	switch name {
+	case "seq":
+		if !c.IsLogSeqIndex || entry.Index == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%0*d", int(c.SeqIndexWidth), entry.Index)
+	case "date":
+		return entry.Time.Format("2006-01-02")
+	case "time":
+		return c.getTimeString(entry.Time)
+	case "level":
+		return entry.Level
+	case "leveltag":
+		if entry.ec == nil {
+			return ""
+		}
+		return entry.ec.Tag
+	case "tag":
+		return entry.Tag
+	case "file":
+		return entry.File
+	case "line":
+		if entry.Line == 0 {
+			return ""
+		}
+		return strconv.Itoa(entry.Line)
+	case "func":
+		return entry.Func
+	case "caller":
+		s := entry.File
+		if entry.Line > 0 {
+			s += ":" + strconv.Itoa(entry.Line)
+		}
+		if entry.Func != "" {
+			if s != "" {
+				s += "-"
+			}
+			s += entry.Func
+		}
+		return s
+	case "msg":
+		return entry.Content
+	case "fields":
+		return strings.TrimPrefix(c.getFieldsString(entry.Fields), " ")
+	}
+	return ""
+}
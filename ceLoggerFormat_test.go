@@ -0,0 +1,146 @@
+package ceLogger
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Read log file as json lines
+func readJsonLines(t *testing.T, filename string) []map[string]interface{} {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		m := make(map[string]interface{})
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatalf("invalid json line %s: %s", scanner.Text(), err.Error())
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestFormatJson(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestFormatJson.log")
+	os.Remove(l.LogFilePath)
+
+	t.Log("SetLogFormat(json)")
+	l.SetLogFormat(LogFormatJson).SetLogCodeFilename(true).SetLogCodeLineNumber(true)
+	l.SetEnable(true)
+	logAllType(l)
+	l.Info("HTML", `<a href="x">"quoted" & more</a>`)
+	l.SetEnable(false)
+
+	lines := readJsonLines(t, l.GetFilename())
+	if len(lines) != 18 {
+		t.Fatalf("%d json lines, want 18", len(lines))
+	}
+
+	m := lines[0]
+	for k, v := range map[string]interface{}{
+		"seq":       1.0,
+		"level":     ECTrace,
+		"level_tag": "T",
+		"tag":       "TraceTag",
+		"file":      "ceLogger_test.go",
+		"msg":       "I am a Trace() test",
+	} {
+		if m[k] != v {
+			t.Errorf("%s is %v, want %v", k, m[k], v)
+		}
+	}
+	if f, _ := m["func"].(string); !strings.HasSuffix(f, ".logAllType") {
+		t.Errorf("func is %v, want *.logAllType", m["func"])
+	}
+	if _, ok := m["timestamp"]; !ok {
+		t.Error("timestamp not found")
+	}
+	if msg := lines[17]["msg"]; msg != `<a href="x">"quoted" & more</a>` {
+		t.Errorf("msg not escaped correctly: %v", msg)
+	}
+}
+
+func TestFormatLogfmt(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestFormatLogfmt.log")
+	os.Remove(l.LogFilePath)
+
+	t.Log("SetLogFormat(logfmt)")
+	l.SetLogFormat(LogFormatLogfmt).SetLogTime(false).SetLogCodeFuncName(false)
+	l.SetEnable(true)
+	l.Info("HTTP", `say "hi" a=b`)
+	l.Warn("", "done")
+	l.InfoW("Key", "unsafe", "my key", 1, "a=b", 2, `"q"`, 3, "", 4)
+	l.SetEnable(false)
+
+	dat, _ := ioutil.ReadFile(l.GetFilename())
+	want := `seq=1 level=Info tag=HTTP msg="say \"hi\" a=b"` + "\n" +
+		`seq=2 level=Warn tag="" msg=done` + "\n" +
+		`seq=3 level=Info tag=Key msg=unsafe my_key=1 a_b=2 _q_=3 _=4` + "\n"
+	if string(dat) != want {
+		t.Errorf("logfmt is\n%s\nwant\n%s", dat, want)
+	}
+}
+
+func TestSinkFormat(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestSinkFormat.log")
+	os.Remove(l.LogFilePath)
+
+	t.Log("Console json, file logfmt")
+	l.GetConsoleSink().SetFormat(LogFormatJson)
+	l.GetFileSink().SetFormat(LogFormatLogfmt)
+	l.SetEnable(true)
+	logAllType(l)
+	l.SetEnable(false)
+
+	dat, _ := ioutil.ReadFile(l.GetFilename())
+	if !strings.HasPrefix(string(dat), "seq=1 ") {
+		t.Errorf("file is not logfmt: %s", dat)
+	}
+	if l.GetConsoleSink().GetFormat() != LogFormatJson || l.GetFileSink().GetFormat() != LogFormatLogfmt {
+		t.Error("wrong sink format")
+	}
+}
+
+func TestTextTemplate(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestTextTemplate.log")
+	os.Remove(l.LogFilePath)
+
+	t.Log("SetTextTemplate")
+	l.SetLogCodeFilename(true).SetLogCodeLineNumber(true).SetLogCodeFuncName(false)
+	l.SetTextTemplate("{{{seq}}} {level:-5}|{leveltag:3} [{tag}] {file}: {msg}")
+	l.SetEnable(true)
+	l.Info("HTTP", "GET /")
+	l.Warn("HTTP", "slow")
+	l.SetEnable(false)
+
+	dat, _ := ioutil.ReadFile(l.GetFilename())
+	want := "{0001} Info |  I [HTTP] ceLoggerFormat_test.go: GET /\n" +
+		"{0002} Warn |  W [HTTP] ceLoggerFormat_test.go: slow\n"
+	if string(dat) != want {
+		t.Errorf("text is\n%s\nwant\n%s", dat, want)
+	}
+
+	t.Log("Invalid template")
+	for _, tmpl := range []string{"{msg", "{unknown}", "{msg:x}", "msg}"} {
+		c := NewCeLoggerConfig()
+		if err := c.CompileTextTemplate(tmpl); err == nil {
+			t.Errorf("compile invalid template %s without error", tmpl)
+		}
+		if c.textTemplate != nil {
+			t.Errorf("invalid template %s is used", tmpl)
+		}
+	}
+}
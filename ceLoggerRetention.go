@@ -0,0 +1,468 @@
+package ceLogger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// ----------
+// Retention
+// ----------
+
+// Retention of rotated log files by MaxBackups, MaxAge and MaxTotalSize,
+// the oldest files are removed in background after each rotation.
+// Rotated log files are the ones derived from LogFilePath or RotateFilePattern,
+// e.g. "test.log" -> "test.log", "test_1.log", "test_2015_03_04.log", "test_1.log.gz",
+// other files with the same prefix are never removed, e.g. "test_access.log" and session files.
+// If IsCompress, rotated files are gzipped before the removal
+type retention struct {
+	patterns     []string       // glob patterns of log files
+	names        *regexp.Regexp // exact names of log files, glob matches are filtered by it
+	current      string         // current log file, never removed
+	maxBackups   uint           // max count of rotated files, 0 means no limit
+	maxAge       time.Duration  // max age of rotated files, 0 means no limit
+	maxTotalSize uint           // max total size of current and rotated files, 0 means no limit
+	compress     []string       // rotated files to be gzipped
+	shiftBase    string         // path of shifted files, e.g. "test.log" for "test.log.1"
+	isShift      bool           // if RotateSchemeShift, e.g. test.log.2 is older than test.log.1
+	isRecover    bool           // if remove partial .gz files left by crash, at the first entry
+}
+
+// Background cleaner of one FileSink, at most one cleanup goroutine is running,
+// requests during cleanup are merged into one
+type retentionCleaner struct {
+	mutex     sync.Mutex // lock for isRunning and pending
+	isRunning bool
+	pending   *retention   // latest request during cleanup, nil if none
+	current   atomic.Value // log file being written by FileSink, never removed, string
+	wg        sync.WaitGroup
+
+	fileMutex   sync.Mutex // lock for renaming and removing log files, never held during gzip
+	compressing string     // rotated file being gzipped, renamed by shiftFiles() if shifted
+}
+
+// Set log file being written, never block since it is called on logging path,
+// a stale request never removes the file just opened, see run()
+func (rc *retentionCleaner) setCurrent(path string) {
+	rc.current.Store(path)
+}
+
+// Log file being written, "" if not opened yet
+func (rc *retentionCleaner) getCurrent() string {
+	current, _ := rc.current.Load().(string)
+	return current
+}
+
+// Request cleanup in background, never block
+func (rc *retentionCleaner) cleanup(r *retention) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if rc.isRunning {
+		// Files to compress are kept in merged request
+		if rc.pending != nil {
+			r.compress = append(rc.pending.compress, r.compress...)
+			r.isRecover = r.isRecover || rc.pending.isRecover
+		}
+		rc.pending = r
+		return
+	}
+	rc.isRunning = true
+
+	rc.wg.Add(1)
+	go func() {
+		defer rc.wg.Done()
+
+		for r != nil {
+			rc.run(r)
+
+			rc.mutex.Lock()
+			r, rc.pending = rc.pending, nil
+			if r == nil {
+				rc.isRunning = false
+			}
+			rc.mutex.Unlock()
+		}
+	}()
+}
+
+// Wait for running cleanup done
+func (rc *retentionCleaner) wait() {
+	rc.wg.Wait()
+}
+
+// Retention of FileSink, nil if no retention limit and no compress
+func (s *FileSink) getRetention() *retention {
+	if s.c.MaxBackups == 0 && s.c.MaxAge == 0 && s.c.MaxTotalSize == 0 && !s.c.IsCompress {
+		return nil
+	}
+
+	r := &retention{
+		current:      s.filename,
+		maxBackups:   s.c.MaxBackups,
+		maxAge:       time.Duration(s.c.MaxAge) * time.Hour,
+		maxTotalSize: s.c.MaxTotalSize,
+		isShift:      s.c.RotateScheme == RotateSchemeShift,
+		shiftBase:    s.basePath,
+	}
+
+	// Suffixes by rotation are auto increment number and time, e.g. "_1", "_2015_03_04", "_2015_03_04_1"
+	var names []string
+	if s.c.RotateFilePattern != "" {
+		// Digits in time layout of file name are replaced, e.g. "log_2006_01_02.log" -> "log_*_*_*.log",
+		// directory is kept as is, e.g. "logs2/log_2006_01_02.log" -> "logs2/log_*_*_*.log"
+		var buf, re bytes.Buffer
+		f, e := s.getFilenameExt(s.c.RotateFilePattern)
+		if dir := filepath.Dir(f); dir != "." {
+			dir = strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+			buf.WriteString(dir)
+			re.WriteString(regexp.QuoteMeta(dir))
+		}
+		f = filepath.Base(f)
+		for i, ch := range f {
+			if !unicode.IsDigit(ch) {
+				buf.WriteRune(ch)
+				re.WriteString(regexp.QuoteMeta(string(ch)))
+			} else if i == 0 || !unicode.IsDigit(rune(f[i-1])) {
+				buf.WriteString("*")
+				re.WriteString(`\d+`)
+			}
+		}
+		if e != "" {
+			buf.WriteString("." + e)
+		}
+		r.patterns = append(r.patterns, buf.String())
+		names = append(names, re.String()+`((?:_\d+)?)`+getExtRegexp(e))
+	} else {
+		// e.g. "test.log" -> "test_*.log"
+		f, e := s.getFilenameExt(s.c.LogFilePath)
+		if e == "" {
+			r.patterns = append(r.patterns, f+"_*")
+		} else {
+			r.patterns = append(r.patterns, f+"_*."+e)
+		}
+		names = append(names, regexp.QuoteMeta(f)+`((?:_\d+)*)`+getExtRegexp(e))
+	}
+	r.patterns = append(r.patterns, s.c.LogFilePath)
+	names = append(names, regexp.QuoteMeta(s.c.LogFilePath)+"()")
+	name := "(?:" + strings.Join(names, "|") + ")"
+
+	// Shifted ones, e.g. "test.log.1"
+	if r.isShift {
+		for _, pattern := range r.patterns {
+			r.patterns = append(r.patterns, pattern+".*")
+		}
+		name += `(?:\.\d+)?`
+	}
+
+	// Compressed ones, e.g. "test_1.log.gz"
+	for _, pattern := range r.patterns {
+		r.patterns = append(r.patterns, pattern+gzipExt)
+	}
+	name += `(?:` + regexp.QuoteMeta(gzipExt) + `)?`
+
+	r.names = regexp.MustCompile("^" + name + "$")
+	return r
+}
+
+// e.g. "log" -> `\.log`, "" -> ""
+func getExtRegexp(ext string) string {
+	if ext == "" {
+		return ""
+	}
+	return regexp.QuoteMeta("." + ext)
+}
+
+// Session ID in file name of session, e.g. "test_job_20150304151617-3.log"
+var sessionIDRegexp = regexp.MustCompile(`_\d{14}-\d+`)
+
+// If path is a log file of r, but not the file of a session
+func (r *retention) isLogFile(path string) bool {
+	m := r.names.FindStringSubmatch(path)
+	return m != nil && !sessionIDRegexp.MatchString(strings.Join(m[1:], ""))
+}
+
+// Compress and remove rotated files of r, current log file may be changed since r requested
+func (rc *retentionCleaner) run(r *retention) {
+	if r.isRecover {
+		rc.fileMutex.Lock()
+		r.current = rc.getCurrent()
+		r.recoverFiles()
+		rc.fileMutex.Unlock()
+	}
+
+	// Shifted file may be shifted again since requested, so all the ones not compressed are picked
+	if r.isShift && len(r.compress) > 0 {
+		r.compress = rc.getShiftedFiles(r.shiftBase)
+	}
+
+	// Files to compress are closed already.
+	// They may be removed by retention before compressed
+	for _, path := range r.compress {
+		if err := rc.compressFile(path); err != nil && !os.IsNotExist(err) {
+			fmt.Println("Compress log file failed.", err.Error())
+		}
+	}
+
+	if r.maxBackups > 0 || r.maxAge > 0 || r.maxTotalSize > 0 {
+		rc.fileMutex.Lock()
+		r.current = rc.getCurrent()
+		r.removeFiles()
+		rc.fileMutex.Unlock()
+	}
+}
+
+// Remove rotated files beyond limits, the oldest first
+func (r *retention) removeFiles() {
+	type logFile struct {
+		path string
+		info os.FileInfo
+	}
+
+	now := time.Now()
+	var files []logFile
+	found := map[string]bool{r.current: true}
+	for _, pattern := range r.patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			fmt.Printf("Invalid log file pattern [%s]: %s\n", pattern, err.Error())
+			continue
+		}
+		for _, path := range matches {
+			if found[path] || !r.isLogFile(path) {
+				continue
+			}
+			found[path] = true
+
+			// Symlink to current log file is skipped too,
+			// so is file written after now, which is opened after r.current read
+			if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() && !info.ModTime().After(now) {
+				files = append(files, logFile{path, info})
+			}
+		}
+	}
+
+	// The newest first, the later rotated one is newer if same ModTime,
+	// e.g. "test_10.log" > "test_9.log" > "test.log"
+	sort.Slice(files, func(i, j int) bool {
+		ti, tj := files[i].info.ModTime(), files[j].info.ModTime()
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		pi, pj := strings.TrimSuffix(files[i].path, gzipExt), strings.TrimSuffix(files[j].path, gzipExt)
+		if r.isShift {
+			// e.g. "test.log.1" > "test.log.2"
+			if ni, nj := getShiftIndex(pi), getShiftIndex(pj); ni != nj {
+				return ni < nj
+			}
+		}
+		if len(pi) != len(pj) {
+			return len(pi) > len(pj)
+		}
+		return pi > pj
+	})
+
+	total := uint(0)
+	if info, err := os.Stat(r.current); err == nil {
+		total = uint(info.Size())
+	}
+
+	kept := uint(0)
+	for _, f := range files {
+		size := uint(f.info.Size())
+		if (r.maxBackups > 0 && kept >= r.maxBackups) ||
+			(r.maxAge > 0 && now.Sub(f.info.ModTime()) > r.maxAge) ||
+			(r.maxTotalSize > 0 && total+size > r.maxTotalSize) {
+			if err := os.Remove(f.path); err != nil {
+				fmt.Println("Remove log file failed.", err.Error())
+			}
+			continue
+		}
+
+		kept++
+		total += size
+	}
+}
+
+// Shift index of rotated file, e.g. "test.log.2" -> 2, 0 if not shifted
+func getShiftIndex(path string) int {
+	n, err := strconv.Atoi(path[strings.LastIndex(path, ".")+1:])
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// ----------
+// Compress
+// ----------
+
+const (
+	gzipExt    = ".gz"
+	gzipTmpExt = ".gz.tmp" // partial gzip file, renamed to .gz when done
+)
+
+// Gzip path to path.gz and remove path, ModTime is kept for retention.
+// It is written to path.gz.tmp first, then renamed, so path.gz is always complete.
+// Existing path.gz is never overwritten, path is kept then.
+// path may be shifted by shiftFiles() during gzip, then the shifted one is renamed and removed
+func (rc *retentionCleaner) compressFile(path string) error {
+	rc.fileMutex.Lock()
+	info, err := os.Stat(path)
+	if err == nil {
+		if _, e := os.Stat(path + gzipExt); e == nil {
+			err = &os.PathError{Op: "compress", Path: path + gzipExt, Err: os.ErrExist}
+		}
+	}
+	if err != nil {
+		rc.fileMutex.Unlock()
+		return err
+	}
+	rc.compressing = path
+	rc.fileMutex.Unlock()
+
+	tmp := path + gzipTmpExt
+	err = gzipFile(path, tmp, info.Mode())
+
+	rc.fileMutex.Lock()
+	defer rc.fileMutex.Unlock()
+
+	path, rc.compressing = rc.compressing, ""
+	if err == nil {
+		if _, e := os.Stat(path + gzipExt); e == nil {
+			err = &os.PathError{Op: "compress", Path: path + gzipExt, Err: os.ErrExist}
+		} else {
+			err = os.Rename(tmp, path+gzipExt)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	os.Chtimes(path+gzipExt, info.ModTime(), info.ModTime())
+	return os.Remove(path)
+}
+
+// Gzip src to dst, dst is synced to disk
+func gzipFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if e := gz.Close(); err == nil {
+		err = e
+	}
+	if e := out.Sync(); err == nil {
+		err = e
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Rename log file, path being compressed is renamed too. rc.fileMutex must be held
+func (rc *retentionCleaner) renameFile(from, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if rc.compressing == from {
+		rc.compressing = to
+	}
+	return nil
+}
+
+// Shifted files not compressed yet, e.g. "test.log.1", "test.log.3" if "test.log.2.gz"
+func (rc *retentionCleaner) getShiftedFiles(base string) []string {
+	rc.fileMutex.Lock()
+	defer rc.fileMutex.Unlock()
+
+	var files []string
+	for n := 1; ; n++ {
+		path := fmt.Sprintf("%s.%d", base, n)
+		_, err := os.Stat(path)
+		_, errGz := os.Stat(path + gzipExt)
+		if os.IsNotExist(err) && os.IsNotExist(errGz) {
+			return files
+		}
+		if err == nil && os.IsNotExist(errGz) {
+			files = append(files, path)
+		}
+	}
+}
+
+// Remove partial .gz files, and original files which have been compressed, left by crash.
+// Original file is only removed if its .gz is complete, see isCompressedOf()
+func (r *retention) recoverFiles() {
+	for _, pattern := range r.patterns {
+		if strings.HasSuffix(pattern, gzipExt) {
+			continue
+		}
+
+		partials, _ := filepath.Glob(pattern + gzipTmpExt)
+		for _, path := range partials {
+			if !r.isLogFile(strings.TrimSuffix(path, gzipTmpExt)) {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				fmt.Println("Remove partial gzip file failed.", err.Error())
+			}
+		}
+
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			if path == r.current || !r.isLogFile(path) {
+				continue
+			}
+			if isCompressedOf(path) {
+				os.Remove(path)
+			}
+		}
+	}
+}
+
+// If path.gz is gzip of path, by uncompressed size in gzip trailer (mod 2^32)
+func isCompressedOf(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	f, err := os.Open(path + gzipExt)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	// Trailer is CRC32 and ISIZE, 4 bytes each, little endian
+	var trailer [8]byte
+	if fi, err := f.Stat(); err != nil || fi.Size() < 18 {
+		return false
+	} else if _, err := f.ReadAt(trailer[:], fi.Size()-8); err != nil {
+		return false
+	}
+	return binary.LittleEndian.Uint32(trailer[4:]) == uint32(info.Size())
+}
@@ -0,0 +1,260 @@
+package ceLogger
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Remove log files by glob pattern
+func removeLogFiles(pattern string) {
+	matches, _ := filepath.Glob(pattern)
+	for _, path := range matches {
+		os.Remove(path)
+	}
+}
+
+func TestMaxBackups(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestMaxBackups.log")
+	removeLogFiles("TestMaxBackups*.log")
+
+	t.Log("SetMaxBackups(2)")
+	l.SetWriteConsole(false).SetMaxEntryNum(2).SetMaxBackups(2)
+	l.SetEnable(true)
+	for i := 0; i < 10; i++ {
+		l.Info("Retention", i)
+	}
+	l.SetEnable(false)
+
+	matches, _ := filepath.Glob("TestMaxBackups*.log")
+	if len(matches) != 3 {
+		t.Errorf("log files are %v, want current one and 2 backups", matches)
+	}
+	for _, path := range []string{"TestMaxBackups_2.log", "TestMaxBackups_3.log", "TestMaxBackups_4.log"} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s is removed", path)
+		}
+	}
+	removeLogFiles("TestMaxBackups*.log")
+}
+
+func TestMaxAgeTotalSize(t *testing.T) {
+	c := NewCeLoggerConfig()
+	c.LogFilePath = "TestMaxAge.log"
+	s := NewFileSink(c)
+	removeLogFiles("TestMaxAge*.log")
+
+	// Backups from newest to oldest, 100 bytes each
+	backups := []string{"TestMaxAge_3.log", "TestMaxAge_2.log", "TestMaxAge_1.log", "TestMaxAge.log"}
+	now := time.Now()
+	for i, path := range backups {
+		f, _ := os.Create(path)
+		f.Write(make([]byte, 100))
+		f.Close()
+		mtime := now.Add(30*time.Minute - time.Duration(i+1)*time.Hour)
+		os.Chtimes(path, mtime, mtime)
+	}
+	os.Create("TestMaxAge_4.log")
+	s.filename = "TestMaxAge_4.log"
+
+	t.Log("SetMaxAge(3)")
+	c.MaxAge = 3
+	s.getRetention().removeFiles()
+	if _, err := os.Stat("TestMaxAge_1.log"); err != nil {
+		t.Error("TestMaxAge_1.log is removed")
+	}
+	if _, err := os.Stat("TestMaxAge.log"); err == nil {
+		t.Error("TestMaxAge.log is not removed")
+	}
+
+	t.Log("SetMaxTotalSize(250)")
+	c.MaxAge, c.MaxTotalSize = 0, 250
+	s.getRetention().removeFiles()
+	for i, path := range backups[:3] {
+		if _, err := os.Stat(path); (err == nil) != (i < 2) {
+			t.Errorf("%s exists: %v", path, err == nil)
+		}
+	}
+	if _, err := os.Stat(s.filename); err != nil {
+		t.Error("current log file is removed")
+	}
+
+	t.Log("SetRotateFilePattern")
+	c.RotateFilePattern = "TestMaxAge_2006_01_02.log"
+	if r := s.getRetention(); r.patterns[0] != "TestMaxAge_*_*_*.log" {
+		t.Errorf("pattern is %s, want TestMaxAge_*_*_*.log", r.patterns[0])
+	}
+	removeLogFiles("TestMaxAge*.log")
+}
+
+func TestCompress(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestCompress.log")
+	removeLogFiles("TestCompress*")
+
+	t.Log("Partial gzip file left by crash")
+	ioutil.WriteFile("TestCompress_9.log.gz.tmp", []byte("partial"), 0644)
+
+	t.Log("SetCompress(true)")
+	l.SetWriteConsole(false).SetMaxEntryNum(2).SetCompress(true).SetMaxBackups(2)
+	l.SetEnable(true)
+	for i := 0; i < 8; i++ {
+		l.Info("Compress", i)
+	}
+	l.SetEnable(false)
+
+	if _, err := os.Stat("TestCompress_9.log.gz.tmp"); err == nil {
+		t.Error("partial gzip file is not removed")
+	}
+	matches, _ := filepath.Glob("TestCompress*")
+	want := []string{"TestCompress_1.log.gz", "TestCompress_2.log.gz", "TestCompress_3.log"}
+	if strings.Join(matches, " ") != strings.Join(want, " ") {
+		t.Errorf("log files are %v, want %v", matches, want)
+	}
+
+	f, err := os.Open("TestCompress_2.log.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, _ := ioutil.ReadAll(gz)
+	if lines := strings.Split(strings.TrimSpace(string(dat)), "\n"); len(lines) != 2 || !strings.HasSuffix(lines[1], "[I][Compress]5") {
+		t.Errorf("wrong content in gzip file: %s", dat)
+	}
+	removeLogFiles("TestCompress*")
+}
+
+func TestCompressNoOverwrite(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestCompressSlow.log")
+	removeLogFiles("TestCompressSlow*")
+
+	t.Log("Compress done between rotations")
+	l.SetWriteConsole(false).SetMaxEntryNum(2).SetCompress(true)
+	l.SetEnable(true)
+	for i := 0; i < 12; i++ {
+		l.Info("Compress", i)
+		time.Sleep(30 * time.Millisecond)
+	}
+	l.SetEnable(false)
+
+	matches, _ := filepath.Glob("TestCompressSlow*")
+	want := []string{"TestCompressSlow.log.gz", "TestCompressSlow_1.log.gz", "TestCompressSlow_2.log.gz",
+		"TestCompressSlow_3.log.gz", "TestCompressSlow_4.log.gz", "TestCompressSlow_5.log"}
+	if strings.Join(matches, " ") != strings.Join(want, " ") {
+		t.Errorf("log files are %v, want %v", matches, want)
+	}
+
+	t.Log("Existing gzip file")
+	ioutil.WriteFile("TestCompressSlow_5.log.gz", []byte("old"), 0644)
+	if err := (&retentionCleaner{}).compressFile("TestCompressSlow_5.log"); !os.IsExist(err) {
+		t.Errorf("compress returns %v, want exist error", err)
+	}
+	if dat, _ := ioutil.ReadFile("TestCompressSlow_5.log.gz"); string(dat) != "old" {
+		t.Error("existing gzip file is overwritten")
+	}
+
+	t.Log("Recover")
+	c := NewCeLoggerConfig()
+	c.LogFilePath, c.IsCompress = "TestCompressSlow.log", true
+	NewFileSink(c).getRetention().recoverFiles()
+	if _, err := os.Stat("TestCompressSlow_5.log"); err != nil {
+		t.Error("log file with incomplete gzip file is removed")
+	}
+	removeLogFiles("TestCompressSlow*")
+}
+
+func TestRetentionNames(t *testing.T) {
+	c := NewCeLoggerConfig()
+	c.LogFilePath, c.MaxBackups = "TestNames.log", 1
+	r := NewFileSink(c).getRetention()
+
+	for _, path := range []string{"TestNames.log", "TestNames_1.log", "TestNames_2015_03_04.log", "TestNames_2015_03_04_12.log", "TestNames_3.log.gz"} {
+		if !r.isLogFile(path) {
+			t.Errorf("%s is not log file", path)
+		}
+	}
+	for _, path := range []string{"TestNames_access.log", "TestNames_job_20150304151617-3.log", "TestNames_1.log.1", "TestNames_1.txt"} {
+		if r.isLogFile(path) {
+			t.Errorf("%s is log file", path)
+		}
+	}
+
+	t.Log("RotateSchemeShift")
+	c.RotateScheme = RotateSchemeShift
+	if r := NewFileSink(c).getRetention(); !r.isLogFile("TestNames.log.2") || !r.isLogFile("TestNames.log.2.gz") {
+		t.Error("shifted file is not log file")
+	}
+
+	t.Log("SetRotateFilePattern")
+	c.RotateFilePattern = "TestNames_2006_01_02.log"
+	r = NewFileSink(c).getRetention()
+	if !r.isLogFile("TestNames_2015_03_04.log") || !r.isLogFile("TestNames_2015_03_04_1.log.1") || r.isLogFile("TestNames_2015_03_xx.log") {
+		t.Error("wrong log file by pattern")
+	}
+
+	t.Log("Files with the same prefix are kept")
+	l := NewCeLogger()
+	l.SetLogFilePath("TestNames.log")
+	removeLogFiles("TestNames*")
+	ioutil.WriteFile("TestNames_access.log", []byte("access"), 0644)
+	l.SetWriteConsole(false).SetMaxEntryNum(1).SetMaxBackups(1).SetSessionFile(true)
+	l.SetEnable(true)
+	s := l.StartSession("job")
+	for i := 0; i < 5; i++ {
+		s.Info("Retention", i)
+	}
+	s.End()
+	l.SetEnable(false)
+
+	for _, path := range []string{"TestNames_access.log", s.GetSessionFilename()} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s is removed", path)
+		}
+	}
+	removeLogFiles("TestNames*")
+}
+
+func TestRetentionDir(t *testing.T) {
+	dirs := []string{"TestRetentionDir1", "TestRetentionDir2", "TestRetentionDir3"}
+	old := time.Now().Add(-time.Hour)
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+		os.Mkdir(dir, 0755)
+		for _, name := range []string{"app_2015_03_04.log", "app_2015_03_05.log"} {
+			path := filepath.Join(dir, name)
+			ioutil.WriteFile(path, []byte("old"), 0644)
+			os.Chtimes(path, old, old)
+		}
+	}
+
+	t.Log("SetRotateFilePattern(TestRetentionDir2/app_2006_01_02.log)")
+	c := NewCeLoggerConfig()
+	c.RotateFilePattern, c.MaxBackups = "TestRetentionDir2/app_2006_01_02.log", 1
+	s := NewFileSink(c)
+	s.filename = "TestRetentionDir2/app_2015_03_06.log"
+	ioutil.WriteFile(s.filename, []byte("current"), 0644)
+	r := s.getRetention()
+	if r.patterns[0] != "TestRetentionDir2/app_*_*_*.log" {
+		t.Errorf("pattern is %s, want TestRetentionDir2/app_*_*_*.log", r.patterns[0])
+	}
+	r.removeFiles()
+
+	for _, dir := range dirs {
+		// The oldest one is removed from its own directory only
+		path := filepath.Join(dir, "app_2015_03_04.log")
+		if _, err := os.Stat(path); (err == nil) != (dir != dirs[1]) {
+			t.Errorf("%s exists: %v", path, err == nil)
+		}
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,185 @@
+package ceLogger
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// ----------
+// Session
+// ----------
+
+// Session is a logger bound to a named unit of work, e.g. a request or a job.
+// Entries logged by it are stamped with session=ID and elapsed time since start,
+// End() writes a summary line with entry count per level.
+// If IsSessionFile and IsWriteFile, entries of the session are also written to its own file,
+// e.g. "test.log" -> "test_<name>_<ID>.log"
+type Session struct {
+	*CeLogger // logger with session=ID bound, shares sinks and config with parent
+
+	ID        string    // e.g. "20150304151617-3"
+	Name      string    // name passed to StartSession()
+	StartTime time.Time // time of StartSession()
+
+	mutex    sync.Mutex
+	counts   map[string]uint  // entry count per level, nil until start line written
+	isEnded  int32            // set to 1 by End()
+	fileSink *sessionFileSink // own log file of session, nil if not IsSessionFile or not IsWriteFile
+}
+
+// Start a session, a start line is written at once
+func (cl *CeLogger) StartSession(name string) *Session {
+	s := &Session{Name: name, StartTime: time.Now()}
+	s.ID = fmt.Sprintf("%s-%d", s.StartTime.Format("20060102150405"), atomic.AddUint64(&cl.sessionCount, 1))
+
+	s.CeLogger = cl.With("session", s.ID)
+	s.CeLogger.session = s
+
+	if cl.IsSessionFile && cl.IsWriteFile {
+		s.fileSink = newSessionFileSink(s, cl.CeLoggerConfig)
+		cl.AddSink(s.fileSink)
+	}
+
+	s.logwWithTagColor(ECInfo, "Session", "start", "name", name)
+
+	s.mutex.Lock()
+	s.counts = make(map[string]uint)
+	s.mutex.Unlock()
+
+	return s
+}
+
+// End session with a summary line, e.g. "end name=job total=5 Info=3 Warn=2",
+// own file of session is closed. Calls after the first one are ignored
+func (s *Session) End() {
+	if !atomic.CompareAndSwapInt32(&s.isEnded, 0, 1) {
+		return
+	}
+
+	counts := s.GetCounts()
+	names := make([]string, 0, len(counts))
+	total := uint(0)
+	for name, n := range counts {
+		names = append(names, name)
+		total += n
+	}
+	// By severity, e.g. Info=3 Warn=2
+	sort.Slice(names, func(i, j int) bool {
+		si, sj := s.getSeverity(names[i]), s.getSeverity(names[j])
+		if si != sj {
+			return si < sj
+		}
+		return names[i] < names[j]
+	})
+
+	keyvals := []interface{}{"name", s.Name, "total", total}
+	for _, name := range names {
+		keyvals = append(keyvals, name, counts[name])
+	}
+	s.logwWithTagColor(ECInfo, "Session", "end", keyvals...)
+
+	if s.fileSink != nil {
+		// Make sure summary line is written before removing the sink
+		if err := s.Flush(context.Background()); err != nil {
+			fmt.Println(err.Error())
+		}
+		s.RemoveSink(s.fileSink)
+		if err := s.fileSink.Close(); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+func (s *Session) IsEnded() bool {
+	return atomic.LoadInt32(&s.isEnded) == 1
+}
+
+// Entry count per level since start, e.g. {"Info": 3, "Warn": 2}
+func (s *Session) GetCounts() map[string]uint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	counts := make(map[string]uint, len(s.counts))
+	for name, n := range s.counts {
+		counts[name] = n
+	}
+	return counts
+}
+
+// Own log file name of session, "" if it has no own file
+func (s *Session) GetSessionFilename() string {
+	if s.fileSink == nil {
+		return ""
+	}
+	return s.fileSink.GetFilename()
+}
+
+func (s *Session) getSeverity(name string) int {
+	if ec, ok := s.ECMap[name]; ok {
+		return ec.Severity
+	}
+	return 0
+}
+
+// Stamp log entry with session and elapsed time, count it by level
+func (s *Session) stamp(entry *LogEntry) {
+	entry.session = s
+	entry.Fields = append(entry.Fields[:len(entry.Fields):len(entry.Fields)], Field{"elapsed", entry.Time.Sub(s.StartTime)})
+
+	if entry.ec == nil || s.IsEnded() {
+		return
+	}
+
+	s.mutex.Lock()
+	if s.counts != nil {
+		s.counts[entry.Level]++
+	}
+	s.mutex.Unlock()
+}
+
+// ----------
+// sessionFileSink
+// ----------
+
+// sessionFileSink writes entries of one session to its own file
+type sessionFileSink struct {
+	*FileSink
+	s *Session
+}
+
+func newSessionFileSink(s *Session, c *CeLoggerConfig) *sessionFileSink {
+	// Same config as parent except filename, e.g. "test.log" -> "test_job_20150304151617-3.log"
+	sc := *c
+	name, ext := (&FileSink{}).getFilenameExt(c.LogFilePath)
+	sc.LogFilePath = fmt.Sprintf("%s_%s_%s", name, getSafeFilename(s.Name), s.ID)
+	if ext != "" {
+		sc.LogFilePath += "." + ext
+	}
+	sc.CurrentLinkPath = ""
+
+	return &sessionFileSink{FileSink: NewFileSink(&sc), s: s}
+}
+
+// Name with path-unsafe characters replaced by '_', e.g. "GET /api" -> "GET__api"
+func getSafeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func (fs *sessionFileSink) WriteEntry(entry *LogEntry) error {
+	if entry.session != fs.s || !entry.isWriteFile() {
+		fs.skipEntry(entry)
+		return nil
+	}
+	return fs.FileSink.WriteEntry(entry)
+}
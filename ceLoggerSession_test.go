@@ -0,0 +1,101 @@
+package ceLogger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	for _, b := range []bool{true, false} {
+		l := NewCeLogger()
+		l.SetLogFilePath("TestSession.log")
+		os.Remove(l.LogFilePath)
+		l.SetWriteConsole(false).SetLogTime(false).SetLogCodeFuncName(false).SetSyncWriteFile(b)
+		l.SetSessionFile(true)
+		s := &memorySink{}
+		l.AddSink(s)
+
+		t.Logf("StartSession() with SetSyncWriteFile(%v)", b)
+		l.SetEnable(true)
+		l.Info("Main", "before")
+		job := l.StartSession("job")
+		job.Info("Step", "one")
+		job.WithTag("Sub").Warn("Step", "two")
+		l.Info("Main", "between")
+		job.InfoW("Step", "three", "n", 3)
+		job.End()
+		job.Info("Step", "after end")
+		job.End()
+		l.SetEnable(false)
+
+		counts := job.GetCounts()
+		if len(counts) != 2 || counts[ECInfo] != 2 || counts[ECWarn] != 1 {
+			t.Errorf("wrong counts %v", counts)
+		}
+		if s.count() != 8 {
+			t.Errorf("%d entries in logger, want 8", s.count())
+		}
+
+		filename := job.GetSessionFilename()
+		if filename != "TestSession_job_"+job.ID+".log" {
+			t.Errorf("wrong session filename %s", filename)
+		}
+		dat, _ := ioutil.ReadFile(filename)
+		os.Remove(filename)
+		lines := strings.Split(strings.TrimSpace(string(dat)), "\n")
+		if len(lines) != 5 {
+			t.Fatalf("%d lines in session file, want 5:\n%s", len(lines), dat)
+		}
+		for i, want := range []string{
+			"[I][Session]start session=" + job.ID + " name=job elapsed=",
+			"[I][Step]one session=" + job.ID + " elapsed=",
+			"[W][Sub.Step]two session=" + job.ID + " elapsed=",
+			"[I][Step]three session=" + job.ID + " n=3 elapsed=",
+			"[I][Session]end session=" + job.ID + " name=job total=3 Info=2 Warn=1 elapsed=",
+		} {
+			if !strings.Contains(lines[i], want) {
+				t.Errorf("line %d is %s, want %s", i, lines[i], want)
+			}
+		}
+	}
+}
+
+func TestSessionFilename(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestSessionFilename.log")
+	os.Remove(l.LogFilePath)
+	l.SetWriteConsole(false).SetSessionFile(true)
+
+	l.SetEnable(true)
+	s := l.StartSession("GET /api/v1?id=1")
+	s.Info("HTTP", "request")
+	s.End()
+	l.SetEnable(false)
+
+	filename := s.GetSessionFilename()
+	if want := "TestSessionFilename_GET__api_v1_id=1_" + s.ID + ".log"; filename != want {
+		t.Errorf("session filename is %s, want %s", filename, want)
+	}
+	dat, err := ioutil.ReadFile(filename)
+	os.Remove(filename)
+	if err != nil || !strings.Contains(string(dat), "request") {
+		t.Errorf("wrong session file %v:\n%s", err, dat)
+	}
+
+	t.Log("SetWriteFile(false)")
+	l.SetWriteFile(false)
+	l.SetEnable(true)
+	s = l.StartSession("job")
+	s.Info("Job", "no file")
+	s.End()
+	l.SetEnable(false)
+
+	matches, _ := filepath.Glob("TestSessionFilename_job_*")
+	if s.GetSessionFilename() != "" || len(matches) != 0 {
+		t.Errorf("session file %s created with file disabled", matches)
+	}
+	removeLogFiles("TestSessionFilename*")
+}
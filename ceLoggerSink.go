@@ -0,0 +1,616 @@
+package ceLogger
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ----------
+// Sink
+// ----------
+
+// Sink is a destination of log entries, e.g. console, file
+type Sink interface {
+	WriteEntry(entry *LogEntry) error // write one log entry
+	Flush() error                     // flush buffered entries if any
+	Close() error                     // release resources
+}
+
+// Syncer is implemented by sinks which can commit flushed entries to stable storage
+type Syncer interface {
+	Sync() error
+}
+
+// Leveler is implemented by sinks which only accept entries not below its level,
+// e.g. "Warn" means Warn/Error/Panic, "" means all
+type Leveler interface {
+	GetLevel() string
+}
+
+// Reopener is implemented by sinks which can reopen files, e.g. after moved by logrotate
+type Reopener interface {
+	Reopen() error
+}
+
+// entrySkipper is implemented by sinks which track entries routed away from them,
+// e.g. FileSink not to mark "X" on the next entry for the skipped index
+type entrySkipper interface {
+	skipEntry(entry *LogEntry)
+}
+
+// ----------
+// ConsoleSink
+// ----------
+
+// ConsoleSink writes log entries to stdout
+type ConsoleSink struct {
+	c *CeLoggerConfig
+
+	format string // format of log entry, LogFormat is used if empty
+	level  string // min level of log entry for this sink only, "" means all
+}
+
+func NewConsoleSink(c *CeLoggerConfig) *ConsoleSink {
+	return &ConsoleSink{c: c}
+}
+
+// Set format of log entry for this sink only, "" means LogFormat
+func (s *ConsoleSink) SetFormat(format string) *ConsoleSink {
+	s.format = format
+	return s
+}
+
+func (s *ConsoleSink) GetFormat() string {
+	return s.c.getFormat(s.format)
+}
+
+// Set min level of log entry for this sink only, besides Level, "" means all
+func (s *ConsoleSink) SetLevel(level string) *ConsoleSink {
+	s.level = level
+	return s
+}
+
+func (s *ConsoleSink) GetLevel() string {
+	return s.level
+}
+
+func (s *ConsoleSink) WriteEntry(entry *LogEntry) error {
+	isColor := s.c.IsLogColor && entry.ec != nil && entry.ec.IsColorConsole
+	_, err := fmt.Println(string(s.c.FormatEntry(s.GetFormat(), entry, isColor)))
+	return err
+}
+
+func (s *ConsoleSink) Flush() error {
+	return nil
+}
+
+func (s *ConsoleSink) Close() error {
+	return nil
+}
+
+// ----------
+// FileSink
+// ----------
+
+// FileSink writes log entries to LogFilePath,
+// switch to a new file with auto increment suffix when MaxFileSize or MaxEntryNum reached,
+// or shift rotated files if RotateSchemeShift, e.g. test.log -> test.log.1 -> test.log.2,
+// or to a new file named by time when RotateTime period ends.
+// The log file is kept open with a buffered writer until rotation or Close()
+type FileSink struct {
+	c      *CeLoggerConfig
+	format string // format of log entry, LogFormat is used if empty
+	level  string // min level of log entry for this sink only, "" means all
+
+	isFirstEntry bool          // init as true to indicate it is first log entry
+	entryIndex   uint          // entry index in current log file
+	entryNum     uint          // entry count in current log file
+	fileSize     uint          // file size of current log file
+	filename     string        // current log file name
+	basePath     string        // log file path of current period, LogFilePath if no time based rotation
+	periodEnd    time.Time     // end of current RotateTime period
+	file         *os.File      // current log file, nil if not opened
+	linkTarget   string        // target of CurrentLinkPath, "" if not linked yet
+	writer       *bufio.Writer // buffered writer of current log file
+
+	cleaner retentionCleaner // remove rotated files by MaxBackups/MaxAge/MaxTotalSize in background
+}
+
+func NewFileSink(c *CeLoggerConfig) *FileSink {
+	s := &FileSink{c: c}
+	s.reset()
+	return s
+}
+
+func (s *FileSink) GetFilename() string {
+	return s.filename
+}
+
+// Set format of log entry for this sink only, "" means LogFormat
+func (s *FileSink) SetFormat(format string) *FileSink {
+	s.format = format
+	return s
+}
+
+func (s *FileSink) GetFormat() string {
+	return s.c.getFormat(s.format)
+}
+
+// Set min level of log entry for this sink only, besides Level, "" means all
+func (s *FileSink) SetLevel(level string) *FileSink {
+	s.level = level
+	return s
+}
+
+func (s *FileSink) GetLevel() string {
+	return s.level
+}
+
+func (s *FileSink) WriteEntry(entry *LogEntry) error {
+	isColor := s.c.IsLogColor && entry.ec != nil && entry.ec.IsColorFile
+	format := s.GetFormat()
+	buf := s.c.FormatEntry(format, entry, isColor)
+
+	if s.c.IsLogOrderFlag && format == LogFormatText && s.c.textTemplate == nil {
+		// Mark "X" in front of log entry if out of order,
+		// entries skipped by level or routing are counted by skipEntry()
+		if entry.Index > 0 && s.entryIndex > 0 && !(entry.Index == s.entryIndex+1 ||
+			(entry.Index == 1 && s.entryIndex == uint(math.Pow10(int(s.c.SeqIndexWidth)))-1)) {
+			buf[0] = 'X'
+		}
+	}
+
+	isRecover := s.isFirstEntry
+	isRotated := s.isFirstEntry
+	rotatedFile := "" // log file rotated away, to be compressed
+
+	// Switch to log file of new period if RotateTime is set,
+	// then it is treated as the first entry of new log file
+	if s.c.RotateTime != RotateNone && (s.isFirstEntry || !entry.Time.Before(s.periodEnd)) {
+		if !s.isFirstEntry {
+			rotatedFile = s.filename
+			if err := s.closeFile(); err != nil {
+				fmt.Println(err.Error())
+			}
+			s.fileSize = 0
+			s.entryNum = 0
+			s.isFirstEntry = true
+			isRotated = true
+		}
+
+		var start time.Time
+		start, s.periodEnd = s.getRotatePeriod(entry.Time)
+		s.basePath = s.getRotateFilename(start)
+		s.filename = s.basePath
+	}
+
+	// If this is the first entry, check log file if available
+	// Refresh filename if nesessary
+	if s.isFirstEntry {
+		if s.c.RotateScheme == RotateSchemeShift {
+			// Always append to current log file
+			s.filename = s.basePath
+			s.loadFileStat()
+		} else if s.c.IsAppendOnStart {
+			// Continue the last log file until limits reached
+			// e.g. "test.log" -> "test_3.log" if "test_4.log" not exist
+			s.filename = s.getLastFilename(s.basePath)
+			s.loadFileStat()
+		} else if s.c.MaxFileSize > 0 || s.c.MaxEntryNum > 0 {
+			if !s.isFileTaken(s.basePath) {
+				// If log file not exist
+				s.filename = s.basePath
+			} else {
+				// If log file exist, try to get next one
+				// e.g. "test.log" -> "test_1.log"
+				s.filename = s.getNextValidFilename(s.basePath)
+			}
+		}
+		s.isFirstEntry = false
+	}
+
+	// Write to a new log file if necessary
+	if (s.c.MaxEntryNum > 0 && s.entryNum >= s.c.MaxEntryNum) ||
+		(s.c.MaxFileSize > 0 && s.fileSize+uint(len(buf))+1 >= s.c.MaxFileSize) {
+		rotatedFile = s.filename
+		if err := s.closeFile(); err != nil {
+			fmt.Println(err.Error())
+		}
+		if s.c.RotateScheme == RotateSchemeShift {
+			if err := s.shiftFiles(); err != nil {
+				fmt.Println("Shift log files failed.", err.Error())
+			}
+			rotatedFile = s.basePath + ".1"
+			s.filename = s.basePath
+		} else {
+			s.filename = s.getNextValidFilename(s.basePath)
+		}
+		isRotated = true
+		// reset log tracking data
+		s.fileSize = 0
+		s.entryNum = 0
+	}
+
+	// Write buf to log file
+	size, err := s.writeLogFile(buf)
+	if err != nil {
+		fmt.Printf("writeLogFile failed at %d, %s\n", entry.Index, err.Error())
+		return err
+	}
+
+	// Update log tracking data
+	if entry.Index > 0 {
+		s.entryIndex = entry.Index
+	}
+	s.fileSize += size
+	s.entryNum++
+
+	// Compress and remove old log files after new one created
+	if isRotated {
+		if r := s.getRetention(); r != nil {
+			if s.c.IsCompress && rotatedFile != "" {
+				r.compress = []string{rotatedFile}
+			}
+			r.isRecover = isRecover && s.c.IsCompress
+			s.cleaner.cleanup(r)
+		}
+	}
+
+	return nil
+}
+
+func (s *FileSink) Flush() error {
+	if s.writer == nil {
+		return nil
+	}
+	return s.writer.Flush()
+}
+
+// Flush and commit current log file to disk
+func (s *FileSink) Sync() error {
+	if s.file == nil {
+		return nil
+	}
+
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Close current log file, it is opened again by next entry,
+// e.g. after moved or truncated by logrotate
+func (s *FileSink) Reopen() error {
+	err := s.closeFile()
+
+	// Log file may be truncated or moved away
+	s.fileSize = 0
+	if size, e := s.getFileSize(s.filename); e == nil {
+		s.fileSize = uint(size)
+	}
+	if s.fileSize == 0 {
+		s.entryNum = 0
+	}
+	// Link may be moved away too
+	s.linkTarget = ""
+
+	return err
+}
+
+// Close current log file, and wait for background cleanup of rotated files
+func (s *FileSink) Close() error {
+	err := s.closeFile()
+	s.cleaner.wait()
+	return err
+}
+
+// Track index of entry not written, e.g. filtered by level, summary entry without index is ignored
+func (s *FileSink) skipEntry(entry *LogEntry) {
+	if entry.Index > 0 {
+		s.entryIndex = entry.Index
+	}
+}
+
+// Reset log tracking data, next entry will be treated as the first one
+func (s *FileSink) reset() {
+	if err := s.closeFile(); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	s.isFirstEntry = true
+	s.entryIndex = 0
+	s.entryNum = 0
+	s.fileSize = 0
+	s.filename = s.c.LogFilePath
+	s.basePath = s.c.LogFilePath
+	s.periodEnd = time.Time{}
+	s.linkTarget = ""
+}
+
+// Switch to another log file, current one will be closed
+func (s *FileSink) setFilename(filename string) {
+	if err := s.closeFile(); err != nil {
+		fmt.Println(err.Error())
+	}
+	s.filename = filename
+	s.basePath = filename
+}
+
+// Open current log file for append
+func (s *FileSink) openFile() error {
+	s.cleaner.setCurrent(s.filename)
+
+	file, err := os.OpenFile(s.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	s.file = file
+	s.writer = bufio.NewWriterSize(file, int(s.c.FileBufferSize))
+
+	if s.c.CurrentLinkPath != "" && s.linkTarget != s.filename {
+		if err := s.updateLink(); err != nil {
+			fmt.Println("Update current log link failed.", err.Error())
+		}
+	}
+	return nil
+}
+
+// Point CurrentLinkPath to current log file atomically,
+// link is created at a temp path then renamed, so it is never missing
+func (s *FileSink) updateLink() error {
+	link := s.c.CurrentLinkPath
+
+	// Relative to link if possible, then log dir can be moved
+	target := s.filename
+	if absLink, err := filepath.Abs(link); err == nil {
+		if absTarget, err := filepath.Abs(s.filename); err == nil {
+			if rel, err := filepath.Rel(filepath.Dir(absLink), absTarget); err == nil {
+				target = rel
+			}
+		}
+	}
+
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.linkTarget = s.filename
+	return nil
+}
+
+// Flush and close current log file
+func (s *FileSink) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.writer.Flush()
+	if e := s.file.Close(); err == nil {
+		err = e
+	}
+	s.file = nil
+	s.writer = nil
+
+	return err
+}
+
+// Write buffer to log file, return size of write bytes
+func (s *FileSink) writeLogFile(buf []byte) (size uint, err error) {
+	if s.file == nil {
+		if err := s.openFile(); err != nil {
+			fmt.Println("Write log failed.", err.Error())
+			return 0, err
+		}
+	}
+
+	s.writer.Write(buf)
+	s.writer.WriteString("\n")
+
+	if s.c.FileBufferSize == 0 {
+		if err := s.writer.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return uint(len(buf)) + 1, nil
+}
+
+func (s *FileSink) getFilenameExt(path string) (name, ext string) {
+	for i := len(path) - 1; i >= 0 && path[i] != '/'; i-- {
+		if path[i] == '.' {
+			return path[:i], path[i+1:]
+		}
+	}
+	return path, ""
+}
+
+func (s *FileSink) getFileSize(path string) (size int64, err error) {
+	fi, err := os.Stat(path)
+	if !(err == nil || os.IsExist(err)) {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// Shift rotated files, e.g. test.log.1 -> test.log.2, test.log -> test.log.1,
+// the compressed ones are shifted too, e.g. test.log.1.gz -> test.log.2.gz,
+// so is the one being compressed in background, see retentionCleaner.compressFile()
+func (s *FileSink) shiftFiles() error {
+	s.cleaner.fileMutex.Lock()
+	defer s.cleaner.fileMutex.Unlock()
+
+	// Find the first missing index
+	n := 1
+	for ; ; n++ {
+		_, err := os.Stat(fmt.Sprintf("%s.%d", s.basePath, n))
+		_, errGz := os.Stat(fmt.Sprintf("%s.%d%s", s.basePath, n, gzipExt))
+		if os.IsNotExist(err) && os.IsNotExist(errGz) {
+			break
+		}
+	}
+
+	for i := n - 1; i > 0; i-- {
+		for _, ext := range []string{"", gzipExt} {
+			from := fmt.Sprintf("%s.%d%s", s.basePath, i, ext)
+			if _, err := os.Stat(from); err == nil {
+				if err := s.cleaner.renameFile(from, fmt.Sprintf("%s.%d%s", s.basePath, i+1, ext)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return s.cleaner.renameFile(s.basePath, s.basePath+".1")
+}
+
+// First log file of auto increment suffix not taken, e.g. "test.log" -> "test_2.log"
+func (s *FileSink) getNextValidFilename(path string) string {
+	i := 0
+	for {
+		i++
+		filename := s.getSuffixFilename(path, i)
+		if !s.isFileTaken(filename) {
+			return filename
+		}
+	}
+}
+
+// Last existing log file of auto increment suffix, path if no suffixed one.
+// If it is compressed already, the next valid one is used instead
+func (s *FileSink) getLastFilename(path string) string {
+	last := path
+	for i := 1; ; i++ {
+		filename := s.getSuffixFilename(path, i)
+		if !s.isFileTaken(filename) {
+			break
+		}
+		last = filename
+	}
+
+	if _, err := os.Stat(last); os.IsNotExist(err) && s.isFileTaken(last) {
+		return s.getNextValidFilename(path)
+	}
+	return last
+}
+
+// If log file or its compressed one exists, e.g. "test_1.log" is taken by "test_1.log.gz"
+func (s *FileSink) isFileTaken(path string) bool {
+	for _, p := range []string{path, path + gzipExt} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// e.g. "test.log", 2 -> "test_2.log"
+func (s *FileSink) getSuffixFilename(path string, i int) string {
+	f, e := s.getFilenameExt(path)
+	if e == "" {
+		return fmt.Sprintf("%s_%d", f, i)
+	}
+	return fmt.Sprintf("%s_%d.%s", f, i, e)
+}
+
+// Init fileSize and entryNum from current log file if exists, entryNum is line count of it
+func (s *FileSink) loadFileStat() {
+	file, err := os.Open(s.filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := file.Read(buf)
+		s.fileSize += uint(n)
+		s.entryNum += uint(bytes.Count(buf[:n], []byte("\n")))
+		if err != nil {
+			break
+		}
+	}
+}
+
+// Start and end of RotateTime period which t is in, periods are aligned to local midnight,
+// e.g. "6h" -> 00:00, 06:00, 12:00, 18:00, the last period of a day ends at midnight
+func (s *FileSink) getRotatePeriod(t time.Time) (start, end time.Time) {
+	d, _ := parseRotateTime(s.c.RotateTime)
+
+	// Use time.Date() instead of Truncate() to be right with time zone and DST
+	year, month, day := t.Date()
+	dayStart := time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	dayEnd := time.Date(year, month, day+1, 0, 0, 0, 0, t.Location())
+
+	switch {
+	case s.c.RotateTime == RotateDaily:
+		return dayStart, dayEnd
+	case d > 24*time.Hour:
+		return dayStart, dayStart.Add(d)
+	case s.c.RotateTime == RotateHourly:
+		start = time.Date(year, month, day, t.Hour(), 0, 0, 0, t.Location())
+	default:
+		start = dayStart.Add(t.Sub(dayStart) / d * d)
+	}
+	end = start.Add(d)
+	if end.After(dayEnd) {
+		end = dayEnd
+	}
+	return start, end
+}
+
+// Log file path of period starting at start, by RotateFilePattern or LogFilePath with time suffix,
+// e.g. "test.log" -> "test_2015_03_04.log" if Daily
+func (s *FileSink) getRotateFilename(start time.Time) string {
+	if s.c.RotateFilePattern != "" {
+		return start.Format(s.c.RotateFilePattern)
+	}
+
+	layout := "2006_01_02_15_04_05"
+	switch s.c.RotateTime {
+	case RotateHourly:
+		layout = "2006_01_02_15"
+	case RotateDaily:
+		layout = "2006_01_02"
+	}
+
+	f, e := s.getFilenameExt(s.c.LogFilePath)
+	if e == "" {
+		return f + "_" + start.Format(layout)
+	}
+	return f + "_" + start.Format(layout) + "." + e
+}
+
+// Period of RotateTime, 0 if no time based rotation
+func parseRotateTime(rotate string) (time.Duration, error) {
+	switch rotate {
+	case RotateNone:
+		return 0, nil
+	case RotateHourly:
+		return time.Hour, nil
+	case RotateDaily:
+		return 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(rotate)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, errors.New("rotate interval less than 1s")
+	}
+	return d, nil
+}
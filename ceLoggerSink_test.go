@@ -0,0 +1,423 @@
+package ceLogger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Sink to keep log entries in memory
+type memorySink struct {
+	mutex   sync.Mutex
+	entries []*LogEntry
+	flushed int
+	closed  bool
+}
+
+func (s *memorySink) WriteEntry(entry *LogEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *memorySink) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.flushed++
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+// Content of all entries
+func (s *memorySink) contents() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var contents []string
+	for _, e := range s.entries {
+		contents = append(contents, e.Content)
+	}
+	return contents
+}
+
+func (s *memorySink) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.entries)
+}
+
+func TestAddRemoveSink(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestAddRemoveSink.log")
+	os.Remove(l.LogFilePath)
+
+	for _, sync := range []bool{true, false} {
+		t.Log("SetSyncWriteFile", sync)
+		s := &memorySink{}
+		l.SetSyncWriteFile(sync)
+		l.AddSink(s)
+		l.SetEnable(true)
+		logAllType(l)
+		l.SetEnable(false)
+
+		if s.count() != 17 {
+			t.Errorf("sink got %d entries, want 17", s.count())
+		}
+		if s.flushed == 0 {
+			t.Error("sink not flushed when log stopped")
+		}
+
+		l.RemoveSink(s)
+		l.SetEnable(true)
+		logAllType(l)
+		l.SetEnable(false)
+
+		if s.count() != 17 {
+			t.Errorf("removed sink got %d entries, want 17", s.count())
+		}
+	}
+}
+
+func TestSinkEntry(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestSinkEntry.log")
+	os.Remove(l.LogFilePath)
+
+	s := &memorySink{}
+	l.SetWriteConsole(false).SetWriteFile(false).SetLogCodeFilename(true)
+	l.AddSink(s)
+	l.SetEnable(true)
+	l.Warn("WarnTag", 100)
+	l.SetEnable(false)
+
+	if s.count() != 1 {
+		t.Fatalf("sink got %d entries, want 1", s.count())
+	}
+	e := s.entries[0]
+	if e.Index != 1 || e.Level != ECWarn || e.Tag != "WarnTag" || e.Content != "100" {
+		t.Errorf("wrong entry %+v", e)
+	}
+	if e.File != "ceLoggerSink_test.go" {
+		t.Errorf("wrong entry file %s", e.File)
+	}
+	if _, err := os.Stat(l.LogFilePath); !os.IsNotExist(err) {
+		t.Error("log file written when SetWriteFile(false)")
+	}
+}
+
+func TestFileSinkBuffer(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestFileSinkBuffer.log")
+	os.Remove(l.LogFilePath)
+
+	t.Log("SetFileBufferSize(64K)")
+	l.SetWriteConsole(false).SetFileBufferSize(64 * 1024).SetFlushInterval(0)
+	l.SetEnable(true)
+	l.Info("InfoTag", "I am a Info() test")
+	if size, _ := l.fileSink.getFileSize(l.GetFilename()); size != 0 {
+		t.Errorf("file size is %d before flush", size)
+	}
+	l.Flush(context.Background())
+	size, _ := l.fileSink.getFileSize(l.GetFilename())
+	if size == 0 {
+		t.Error("file is empty after flush")
+	}
+
+	t.Log("Flush after Error")
+	l.Error("ErrorTag", "I am a Error() test")
+	if n, _ := l.fileSink.getFileSize(l.GetFilename()); n <= size {
+		t.Error("file not flushed after Error")
+	}
+	l.SetEnable(false)
+
+	t.Log("SetFlushInterval(10)")
+	os.Remove(l.LogFilePath)
+	l.SetFlushInterval(10)
+	l.SetEnable(true)
+	l.Info("InfoTag", "I am a Info() test")
+	time.Sleep(100 * time.Millisecond)
+	if size, _ := l.fileSink.getFileSize(l.GetFilename()); size == 0 {
+		t.Error("file not flushed by interval")
+	}
+	l.SetEnable(false)
+}
+
+// Sink blocks in WriteEntry until chRelease closed
+type blockingSink struct {
+	memorySink
+	chRelease chan struct{}
+}
+
+func (s *blockingSink) WriteEntry(entry *LogEntry) error {
+	<-s.chRelease
+	return s.memorySink.WriteEntry(entry)
+}
+
+func TestRotatePeriod(t *testing.T) {
+	c := NewCeLoggerConfig()
+	s := NewFileSink(c)
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2015, 3, day, hour, min, 0, 0, time.Local)
+	}
+
+	for _, tc := range []struct {
+		rotate     string
+		t          time.Time
+		start, end time.Time
+	}{
+		{RotateHourly, at(4, 15, 16), at(4, 15, 0), at(4, 16, 0)},
+		{RotateDaily, at(4, 23, 59), at(4, 0, 0), at(5, 0, 0)},
+		{RotateDaily, at(5, 0, 0), at(5, 0, 0), at(6, 0, 0)},
+		{"6h", at(4, 13, 0), at(4, 12, 0), at(4, 18, 0)},
+		{"7h", at(4, 23, 0), at(4, 21, 0), at(5, 0, 0)},
+		{"30m", at(4, 23, 45), at(4, 23, 30), at(5, 0, 0)},
+	} {
+		c.RotateTime = tc.rotate
+		start, end := s.getRotatePeriod(tc.t)
+		if !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("%s period of %v is %v - %v, want %v - %v", tc.rotate, tc.t, start, end, tc.start, tc.end)
+		}
+	}
+
+	t.Log("Invalid RotateTime")
+	for _, rotate := range []string{"Weekly", "10ms", "-1h"} {
+		c.RotateTime = rotate
+		if c.ValidateConfig(); c.RotateTime != RotateNone {
+			t.Errorf("invalid RotateTime %s is used", rotate)
+		}
+	}
+}
+
+func TestFileSinkRotateTime(t *testing.T) {
+	c := NewCeLoggerConfig()
+	c.LogFilePath = "TestRotateTime.log"
+	c.RotateTime = RotateDaily
+	s := NewFileSink(c)
+
+	t.Log("Daily rotation across midnight")
+	files := []string{"TestRotateTime_2015_03_04.log", "TestRotateTime_2015_03_05.log", "TestRotateTime_2015_03_05_1.log"}
+	for _, f := range files {
+		os.Remove(f)
+	}
+	for i, tm := range []time.Time{
+		time.Date(2015, 3, 4, 23, 59, 59, 0, time.Local),
+		time.Date(2015, 3, 5, 0, 0, 0, 0, time.Local),
+		time.Date(2015, 3, 5, 0, 0, 1, 0, time.Local),
+	} {
+		s.WriteEntry(&LogEntry{Index: uint(i + 1), Time: tm, Content: "rotate"})
+	}
+	s.Close()
+
+	for i, want := range []int{1, 2, 0} {
+		dat, _ := ioutil.ReadFile(files[i])
+		if n := strings.Count(string(dat), "rotate"); n != want {
+			t.Errorf("%d entries in %s, want %d", n, files[i], want)
+		}
+		os.Remove(files[i])
+	}
+
+	t.Log("SetRotateFilePattern")
+	c.RotateFilePattern = "TestRotateTime_20060102.log"
+	s.reset()
+	s.WriteEntry(&LogEntry{Index: 1, Time: time.Date(2015, 3, 4, 12, 0, 0, 0, time.Local), Content: "rotate"})
+	s.Close()
+	if s.GetFilename() != "TestRotateTime_20150304.log" {
+		t.Errorf("filename is %s, want TestRotateTime_20150304.log", s.GetFilename())
+	}
+	os.Remove(s.GetFilename())
+}
+
+func TestRotateSchemeShift(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestShift.log")
+	removeLogFiles("TestShift.log*")
+
+	t.Log("SetRotateScheme(Shift)")
+	l.SetWriteConsole(false).SetLogTime(false).SetLogCodeFuncName(false).SetLogColor(false)
+	l.SetMaxEntryNum(2).SetRotateScheme(RotateSchemeShift).SetMaxBackups(2).SetCompress(true)
+	l.SetEnable(true)
+	for i := 0; i < 7; i++ {
+		l.Info("Shift", i)
+	}
+	l.SetEnable(false)
+
+	if l.GetFilename() != "TestShift.log" {
+		t.Errorf("current log file is %s, want TestShift.log", l.GetFilename())
+	}
+	matches, _ := filepath.Glob("TestShift.log*")
+	want := []string{"TestShift.log", "TestShift.log.1.gz", "TestShift.log.2.gz"}
+	if strings.Join(matches, " ") != strings.Join(want, " ") {
+		t.Errorf("log files are %v, want %v", matches, want)
+	}
+	if dat, _ := ioutil.ReadFile("TestShift.log"); string(dat) != "[0007] [I][Shift]6\n" {
+		t.Errorf("wrong current log file: %s", dat)
+	}
+	removeLogFiles("TestShift.log*")
+
+	t.Log("Shift during compress")
+	l.SetMaxBackups(0)
+	l.SetEnable(true)
+	for i := 0; i < 40; i++ {
+		l.Info("Shift", i)
+	}
+	l.SetEnable(false)
+
+	matches, _ = filepath.Glob("TestShift.log*")
+	if len(matches) != 20 {
+		t.Errorf("%d log files, want 20: %v", len(matches), matches)
+	}
+	var lines []string
+	for _, path := range matches {
+		dat, err := ioutil.ReadFile(path)
+		if strings.HasSuffix(path, gzipExt) {
+			var gz *gzip.Reader
+			if gz, err = gzip.NewReader(bytes.NewReader(dat)); err == nil {
+				dat, err = ioutil.ReadAll(gz)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.Split(strings.TrimSpace(string(dat)), "\n")...)
+	}
+	sort.Strings(lines)
+	for i := 1; i < len(lines); i++ {
+		if lines[i] == lines[i-1] {
+			t.Errorf("duplicate entry %s", lines[i])
+		}
+	}
+	if len(lines) != 40 {
+		t.Errorf("%d entries in log files, want 40", len(lines))
+	}
+	removeLogFiles("TestShift.log*")
+}
+
+func TestReopenFiles(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestReopen.log")
+	removeLogFiles("TestReopen.log*")
+
+	t.Log("ReopenFiles() after moved away")
+	l.SetWriteConsole(false).SetLogTime(false).SetLogCodeFuncName(false).SetLogColor(false)
+	l.SetReopenOnSighup(true)
+	l.SetEnable(true)
+	l.Info("Reopen", "before")
+	l.Flush(context.Background())
+	os.Rename("TestReopen.log", "TestReopen.log.moved")
+	l.ReopenFiles()
+	l.Info("Reopen", "after")
+	l.Flush(context.Background())
+
+	if dat, _ := ioutil.ReadFile("TestReopen.log"); string(dat) != "[0002] [I][Reopen]after\n" {
+		t.Errorf("wrong reopened log file: %s", dat)
+	}
+
+	t.Log("Reopen on SIGHUP")
+	os.Rename("TestReopen.log", "TestReopen.log.moved")
+	p, _ := os.FindProcess(os.Getpid())
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		l.SetEnable(false)
+		t.Skip("SIGHUP not supported:", err.Error())
+	}
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		l.Info("Reopen", "signal")
+		l.Flush(context.Background())
+		if _, err := os.Stat("TestReopen.log"); err == nil {
+			break
+		}
+	}
+	l.SetEnable(false)
+
+	if _, err := os.Stat("TestReopen.log"); err != nil {
+		t.Error("log file not reopened on SIGHUP")
+	}
+	removeLogFiles("TestReopen.log*")
+}
+
+func TestAppendOnStart(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestAppend.log")
+	removeLogFiles("TestAppend*.log")
+
+	t.Log("SetAppendOnStart(true)")
+	l.SetWriteConsole(false).SetMaxEntryNum(5).SetAppendOnStart(true)
+	for _, n := range []int{3, 4, 4} {
+		l.SetEnable(true)
+		for i := 0; i < n; i++ {
+			l.Info("Append", i)
+		}
+		l.SetEnable(false)
+	}
+
+	for path, want := range map[string]int{"TestAppend.log": 5, "TestAppend_1.log": 5, "TestAppend_2.log": 1} {
+		dat, _ := ioutil.ReadFile(path)
+		if n := strings.Count(string(dat), "\n"); n != want {
+			t.Errorf("%d entries in %s, want %d", n, path, want)
+		}
+	}
+	removeLogFiles("TestAppend*.log")
+}
+
+func TestCurrentLink(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestLink.log")
+	removeLogFiles("TestLink*")
+	if err := os.Symlink("TestLink.log", "TestLink.current.log"); err != nil {
+		t.Skip("symlink not supported:", err.Error())
+	}
+
+	t.Log("SetCurrentLinkPath(TestLink.current.log)")
+	l.SetWriteConsole(false).SetMaxEntryNum(2).SetCurrentLinkPath("TestLink.current.log")
+	l.SetEnable(true)
+	for i := 0; i < 5; i++ {
+		l.Info("Link", i)
+		if target, err := os.Readlink("TestLink.current.log"); err != nil || target != l.GetFilename() {
+			t.Errorf("link is %s (%v), want %s", target, err, l.GetFilename())
+		}
+	}
+	l.SetEnable(false)
+
+	if _, err := os.Lstat("TestLink.current.log.tmp"); err == nil {
+		t.Error("temp link is left")
+	}
+
+	t.Log("Link removed, then the same log file continued by SetAppendOnStart(true)")
+	os.Remove("TestLink.current.log")
+	l.SetAppendOnStart(true).SetMaxEntryNum(10)
+	l.SetEnable(true)
+	l.Info("Link", "restarted")
+	if target, err := os.Readlink("TestLink.current.log"); err != nil || target != "TestLink_2.log" {
+		t.Errorf("link is %s (%v), want TestLink_2.log", target, err)
+	}
+
+	t.Log("Link removed, then ReopenFiles()")
+	os.Remove("TestLink.current.log")
+	l.ReopenFiles()
+	l.Info("Link", "reopened")
+	if target, err := os.Readlink("TestLink.current.log"); err != nil || target != "TestLink_2.log" {
+		t.Errorf("link is %s (%v), want TestLink_2.log", target, err)
+	}
+	l.SetEnable(false)
+	removeLogFiles("TestLink*")
+}
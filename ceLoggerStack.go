@@ -0,0 +1,148 @@
+package ceLogger
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// ----------
+// Stack
+// ----------
+
+// StackFrame is one frame of stack trace captured for entry config with IsStack
+type StackFrame struct {
+	Func string // full func name, e.g. "main.(*Server).serve"
+	File string // full path of file, e.g. "/src/main/server.go"
+	Line int
+}
+
+// e.g. "main.(*Server).serve (/src/main/server.go:12)"
+func (f StackFrame) String() string {
+	return fmt.Sprintf("%s (%s:%d)", f.Func, f.File, f.Line)
+}
+
+// Package path of ceLogger, e.g. "github.com/etworker/ceLogger"
+var selfPackage = func() string {
+	pc, _, _, _ := runtime.Caller(0)
+	name := runtime.FuncForPC(pc).Name()
+	i := strings.LastIndex(name, "/") + 1
+	return name[:i+strings.Index(name[i:], ".")]
+}()
+
+// Capture stack trace of log call, frames of ceLogger are filtered, at most StackDepth frames
+func (cl *CeLogger) getStack() []StackFrame {
+	if cl.StackDepth == 0 {
+		return nil
+	}
+
+	// Some more for frames of ceLogger
+	pcs := make([]uintptr, int(cl.StackDepth)+16+cl.callerSkip)
+	n := runtime.Callers(2, pcs)
+	return cl.getStackFrames(pcs[:n], cl.callerSkip)
+}
+
+// Stack trace of program counters returned by runtime.Callers(), at most StackDepth frames.
+// Frames of ceLogger are filtered, then the first skip frames and helper frames on top, see Helper()
+func (cl *CeLogger) getStackFrames(pcs []uintptr, skip int) []StackFrame {
+	if len(pcs) == 0 {
+		return nil
+	}
+	frames := runtime.CallersFrames(pcs)
+
+	var stack []StackFrame
+	for uint(len(stack)) < cl.StackDepth {
+		frame, more := frames.Next()
+		switch {
+		case isSelfFrame(frame):
+		case skip > 0:
+			skip--
+		case len(stack) == 0 && cl.isHelper(frame.Function):
+		default:
+			stack = append(stack, StackFrame{Func: frame.Function, File: frame.File, Line: frame.Line})
+		}
+		if !more {
+			break
+		}
+	}
+	return stack
+}
+
+// If frame is in ceLogger, but not in its tests
+func isSelfFrame(frame runtime.Frame) bool {
+	if strings.HasSuffix(frame.File, "_test.go") {
+		return false
+	}
+
+	name := frame.Function
+	if !strings.HasPrefix(name, selfPackage) {
+		return false
+	}
+	return strings.HasPrefix(name[len(selfPackage):], ".")
+}
+
+// ----------
+// Caller
+// ----------
+
+// Mark the calling func as log helper like testing.T.Helper(), e.g. a wrapper func of log calls.
+// Its frame is skipped to find caller of log call, for all loggers sharing state with cl
+func (cl *CeLogger) Helper() {
+	var pcs [1]uintptr
+	if runtime.Callers(2, pcs[:]) == 0 {
+		return
+	}
+
+	frame, _ := runtime.CallersFrames(pcs[:]).Next()
+	if _, ok := cl.helpers.Load(frame.Function); !ok {
+		cl.helpers.Store(frame.Function, true)
+	}
+}
+
+func (cl *CeLogger) isHelper(name string) bool {
+	_, ok := cl.helpers.Load(name)
+	return ok
+}
+
+// Frame of log call, like runtime.Caller(skip) called by the caller of getCaller().
+// callerSkip more frames are skipped, then helper frames, see AddCallerSkip() and Helper()
+func (cl *CeLogger) getCaller(skip int) (runtime.Frame, bool) {
+	var pcs [32]uintptr
+	n := runtime.Callers(skip+2+cl.callerSkip, pcs[:])
+	if n == 0 {
+		return runtime.Frame{}, false
+	}
+
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !more || !cl.isHelper(frame.Function) {
+			return frame, true
+		}
+	}
+}
+
+// ----------
+// Stack format
+// ----------
+
+// Stack trace in text format, one indented frame per line,
+// e.g. "\n\tmain.test (/src/main/abc.go:12)"
+func (c *CeLoggerConfig) getStackString(stack []StackFrame) string {
+	var buf bytes.Buffer
+	for _, f := range stack {
+		buf.WriteString("\n\t")
+		buf.WriteString(f.String())
+	}
+	return buf.String()
+}
+
+// Stack trace as array of frame strings in json format
+func (c *CeLoggerConfig) getStackStrings(stack []StackFrame) []string {
+	frames := make([]string, len(stack))
+	for i, f := range stack {
+		frames[i] = f.String()
+	}
+	return frames
+}
@@ -0,0 +1,126 @@
+package ceLogger
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func logStackError(l *CeLogger) {
+	l.Error("StackTag", "I am a Error() test")
+}
+
+func TestStack(t *testing.T) {
+	l := NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false).SetLogTime(false).SetLogCodeFuncName(false).SetLogColor(false)
+	s := &memorySink{}
+	l.AddSink(s)
+
+	t.Log("SetStackLevel(Error)")
+	l.SetStackLevel(ECError)
+	l.SetEnable(true)
+	l.Warn("StackTag", "I am a Warn() test")
+	logStackError(l)
+	l.SetStackDepth(1)
+	logStackError(l)
+	l.SetEnable(false)
+
+	if s.entries[0].Stack != nil {
+		t.Error("stack of Warn is captured")
+	}
+	e := s.entries[1]
+	if len(e.Stack) < 2 || !strings.HasSuffix(e.Stack[0].Func, ".logStackError") ||
+		!strings.HasSuffix(e.Stack[1].Func, ".TestStack") || !strings.HasSuffix(e.Stack[0].File, "ceLoggerStack_test.go") {
+		t.Fatalf("wrong stack %v", e.Stack)
+	}
+	if len(s.entries[2].Stack) != 1 {
+		t.Errorf("%d frames, want 1", len(s.entries[2].Stack))
+	}
+
+	t.Log("Text format")
+	lines := strings.Split(string(l.FormatEntry(LogFormatText, e, false)), "\n")
+	if lines[0] != "[0002] [E][StackTag]I am a Error() test" || lines[1] != "\t"+e.Stack[0].String() {
+		t.Errorf("wrong text %v", lines)
+	}
+
+	t.Log("Json format")
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(l.FormatEntry(LogFormatJson, e, false), &m); err != nil {
+		t.Fatal(err)
+	}
+	if stack, ok := m["stack"].([]interface{}); !ok || len(stack) != len(e.Stack) || stack[0] != e.Stack[0].String() {
+		t.Errorf("wrong json stack %v", m["stack"])
+	}
+
+	t.Log("Logfmt format")
+	if logfmt := string(l.FormatEntry(LogFormatLogfmt, e, false)); strings.Contains(logfmt, "\n") || !strings.Contains(logfmt, ` stack="`) {
+		t.Errorf("wrong logfmt stack %s", logfmt)
+	}
+
+	t.Log("SetStackLevel(\"\")")
+	if l.SetStackLevel("").ECMap[ECPanic].IsStack {
+		t.Error("stack not disabled")
+	}
+}
+
+// Wrapper funcs of log calls
+var wrappedLogger *CeLogger
+
+func logWrapped(msg string) {
+	wrappedLogger.Info("Caller", msg)
+}
+
+func logHelper(l *CeLogger, msg string) {
+	l.Helper()
+	l.Info("Caller", msg)
+}
+
+func logNestedHelper(l *CeLogger, msg string) {
+	l.Helper()
+	logHelper(l, msg)
+}
+
+func enterHelper(l *CeLogger) string {
+	l.Helper()
+	return l.EnterFunc()
+}
+
+func TestCaller(t *testing.T) {
+	l := NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false).SetLogTime(false).SetLogColor(false)
+	l.SetLogCodeFilename(true).SetLogCodeLineNumber(true).SetLogCodeFuncName(true)
+	s := &memorySink{}
+	l.AddSink(s)
+	wrappedLogger = l.AddCallerSkip(1)
+
+	l.SetEnable(true)
+	l.SetStackLevel(ECInfo)
+	l.SetPackageLevel("testing", ECWarn)
+
+	t.Log("AddCallerSkip(1)")
+	logWrapped("I am a AddCallerSkip() test")
+
+	t.Log("Helper()")
+	logHelper(l, "I am a Helper() test")
+	logNestedHelper(l.WithTag("Child"), "I am a nested Helper() test")
+	funcName := enterHelper(l)
+
+	t.Log("Package of caller")
+	l.AddCallerSkip(1).Info("Caller", "I am logged by testing")
+	l.SetEnable(false)
+
+	if s.count() != 4 {
+		t.Fatalf("%d entries, want 4", s.count())
+	}
+	for i, e := range s.entries[:3] {
+		if !strings.HasSuffix(e.Func, ".TestCaller") || e.File != "ceLoggerStack_test.go" {
+			t.Errorf("entry %d is logged by %s-%s", i, e.File, e.Func)
+		}
+		if len(e.Stack) == 0 || !strings.HasSuffix(e.Stack[0].Func, ".TestCaller") {
+			t.Errorf("wrong stack of entry %d %v", i, e.Stack)
+		}
+	}
+	if !strings.HasSuffix(funcName, ".TestCaller") || !strings.HasSuffix(s.entries[3].Content, ".TestCaller") {
+		t.Errorf("wrong func name %s of EnterFunc()", funcName)
+	}
+}
@@ -1,9 +1,13 @@
 package ceLogger
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -148,6 +152,33 @@ func TestLogOrderFlag(t *testing.T) {
 	l.SetEnable(true)
 	logAllType(l)
 	l.SetEnable(false)
+
+	t.Log("Entries routed away are not out of order")
+	l = NewCeLogger()
+	l.SetLogFilePath("TestLogOrderFlagRouted.log")
+	os.Remove(l.LogFilePath)
+	l.SetWriteConsole(false).SetLogOrderFlag(true).SetSyncWriteFile(true)
+	l.ECMap[ECTrace].IsWriteFile = false
+	l.GetFileSink().SetLevel(ECInfo)
+	l.SetEnable(true)
+	l.Info("Order", "1")
+	l.Trace("Order", "no")
+	l.Info("Order", "2")
+	l.Debug("Order", "no")
+	l.Info("Order", "3")
+	l.SetEnable(false)
+
+	dat, _ := ioutil.ReadFile(l.LogFilePath)
+	os.Remove(l.LogFilePath)
+	lines := strings.Split(strings.TrimSpace(string(dat)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("%d lines, want 3:\n%s", len(lines), dat)
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "X") {
+			t.Errorf("in-order entry marked %s", line)
+		}
+	}
 }
 
 func TestLogSeqIndex(t *testing.T) {
@@ -464,6 +495,537 @@ func logAllType(l *CeLogger) {
 	l.Error("ErrorTag", "I am a Error() test")
 	l.Errorf("ErrorTag", "I am a Error(...) test:%s", "Error something")
 
-	l.Panic("PanicTag", "I am a Panic() test")
-	l.Panicf("PanicTag", "I am a Panic(...) test:%s", "Panic something")
+	logRecover(func() { l.Panic("PanicTag", "I am a Panic() test") })
+	logRecover(func() { l.Panicf("PanicTag", "I am a Panic(...) test:%s", "Panic something") })
+}
+
+// Call f which may panic, return recovered value
+func logRecover(f func()) (r interface{}) {
+	defer func() {
+		r = recover()
+	}()
+
+	f()
+	return nil
+}
+
+func TestEntryConfigRouting(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestEntryConfigRouting.log")
+	os.Remove(l.LogFilePath)
+
+	t.Log("Trace to console only, colorize console only")
+	l.ECMap[ECTrace].IsWriteFile = false
+	l.ECMap[ECError].IsColorFile = false
+	l.SetLogColor(true)
+	l.SetEnable(true)
+	logAllType(l)
+	l.SetEnable(false)
+
+	dat, err := ioutil.ReadFile(l.GetFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(dat), "[T]") {
+		t.Error("Trace written to file")
+	}
+	if !strings.Contains(string(dat), "[E]") {
+		t.Error("Error not written to file")
+	}
+	if strings.Contains(string(dat), "\x1b[") {
+		t.Error("color written to file")
+	}
+
+	t.Log("Colorize file")
+	os.Remove(l.LogFilePath)
+	l.ECMap[ECError].IsColorFile = true
+	l.SetEnable(true)
+	l.Error("ErrorTag", "I am a Error() test")
+	l.SetEnable(false)
+
+	dat, _ = ioutil.ReadFile(l.GetFilename())
+	if !strings.Contains(string(dat), "\x1b[") {
+		t.Error("color not written to file")
+	}
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	for _, policy := range []string{OverflowBlock, OverflowDropNewest, OverflowDropOldest} {
+		t.Log("SetOverflowPolicy", policy)
+
+		l := NewCeLogger()
+		l.SetWriteConsole(false).SetWriteFile(false).SetSyncWriteFile(false)
+		l.SetChanLen(2).SetOverflowPolicy(policy)
+
+		s := &blockingSink{chRelease: make(chan struct{})}
+		l.AddSink(s)
+		l.SetEnable(true)
+
+		if policy == OverflowBlock {
+			time.AfterFunc(50*time.Millisecond, func() { close(s.chRelease) })
+		}
+		for i := 0; i < 10; i++ {
+			l.Info("OverflowTag", i)
+		}
+		if policy != OverflowBlock {
+			close(s.chRelease)
+		}
+		l.SetEnable(false)
+
+		contents := s.contents()
+		if uint64(len(contents))+l.GetDropCount() != 10 {
+			t.Errorf("%s: %d written + %d dropped != 10", policy, len(contents), l.GetDropCount())
+		}
+		for i := 1; i < len(s.entries); i++ {
+			if s.entries[i].Index <= s.entries[i-1].Index {
+				t.Errorf("%s: entries out of order %v", policy, contents)
+				break
+			}
+		}
+
+		switch policy {
+		case OverflowBlock:
+			if len(contents) != 10 {
+				t.Errorf("%s: %d entries written, want 10", policy, len(contents))
+			}
+		case OverflowDropNewest:
+			if l.GetDropCount() == 0 || contents[0] != "0" {
+				t.Errorf("%s: newest entries not dropped %v", policy, contents)
+			}
+		case OverflowDropOldest:
+			if l.GetDropCount() == 0 || contents[len(contents)-1] != "9" {
+				t.Errorf("%s: oldest entries not dropped %v", policy, contents)
+			}
+		}
+	}
+}
+
+func TestFlushClose(t *testing.T) {
+	l := NewCeLogger()
+	l.SetLogFilePath("TestFlushClose.log")
+	os.Remove(l.LogFilePath)
+
+	countLines := func() int {
+		dat, _ := ioutil.ReadFile(l.GetFilename())
+		return strings.Count(string(dat), "\n")
+	}
+
+	t.Log("Flush(ctx)")
+	l.SetWriteConsole(false).SetSyncWriteFile(false).SetFileBufferSize(64 * 1024)
+	l.SetEnable(true)
+	logAllType(l)
+	if err := l.Flush(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if n := countLines(); n != 17 {
+		t.Errorf("%d entries in file after flush, want 17", n)
+	}
+
+	t.Log("Close(ctx)")
+	if err := l.Close(context.Background()); err != nil {
+		t.Error(err)
+	}
+	logAllType(l)
+	l.SetEnable(true)
+	logAllType(l)
+	if l.IsEnable {
+		t.Error("log enabled after close")
+	}
+	if n := countLines(); n != 17 {
+		t.Errorf("%d entries in file after close, want 17", n)
+	}
+	if err := l.Close(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	l := NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false).SetSyncWriteFile(false)
+
+	s := &blockingSink{chRelease: make(chan struct{})}
+	l.AddSink(s)
+	l.SetEnable(true)
+	l.Info("FlushTag", "I am blocked")
+
+	t.Log("Flush(ctx) timeout")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("flush return %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(s.chRelease)
+	if err := l.Close(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if s.count() != 1 || !s.closed {
+		t.Error("sink not written or closed")
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	l := NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false).SetSyncWriteFile(false).SetChanLen(1)
+
+	s := &blockingSink{chRelease: make(chan struct{})}
+	l.AddSink(s)
+	l.SetEnable(true)
+
+	t.Log("Flush(ctx) timeout with writer blocked on full queue")
+	chDone := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			l.Info("CloseTag", i)
+		}
+		close(chDone)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Flush(ctx); err != context.DeadlineExceeded || time.Since(start) > time.Second {
+		t.Errorf("flush return %v after %v, want %v", err, time.Since(start), context.DeadlineExceeded)
+	}
+	close(s.chRelease)
+	<-chDone
+
+	t.Log("Close(ctx) timeout, then retry")
+	s = &blockingSink{chRelease: make(chan struct{})}
+	l = NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false).SetSyncWriteFile(false)
+	l.AddSink(s)
+	l.SetEnable(true)
+	l.Info("CloseTag", "I am blocked")
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		if err := l.Close(ctx); err != context.DeadlineExceeded {
+			t.Errorf("close return %v, want %v", err, context.DeadlineExceeded)
+		}
+		cancel()
+	}
+	if s.closed {
+		t.Error("sink closed before entries written")
+	}
+
+	close(s.chRelease)
+	if err := l.Close(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if s.count() != 1 || !s.closed {
+		t.Error("sink not written or closed")
+	}
+}
+
+func TestCloseWhileLogging(t *testing.T) {
+	for _, b := range []bool{true, false} {
+		t.Logf("Close(ctx) while logging with SetSyncWriteFile(%v)", b)
+		l := NewCeLogger()
+		l.SetWriteConsole(false).SetWriteFile(false).SetSyncWriteFile(b)
+		s := &memorySink{}
+		l.AddSink(s)
+		l.SetEnable(true)
+
+		var wg sync.WaitGroup
+		chStop := make(chan struct{})
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-chStop:
+						return
+					default:
+						l.Info("CloseTag", "logging")
+					}
+				}
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		if err := l.Close(context.Background()); err != nil {
+			t.Error(err)
+		}
+		n := s.count()
+		time.Sleep(10 * time.Millisecond)
+		close(chStop)
+		wg.Wait()
+
+		if !s.closed || s.count() != n {
+			t.Errorf("sink closed %v, %d entries written after close", s.closed, s.count()-n)
+		}
+	}
+}
+
+func TestContinueSeqIndex(t *testing.T) {
+	for _, b := range []bool{false, true} {
+		t.Log("SetContinueSeqIndex", b)
+
+		l := NewCeLogger()
+		l.SetWriteConsole(false).SetWriteFile(false).SetContinueSeqIndex(b)
+		s := &memorySink{}
+		l.AddSink(s)
+
+		l.SetEnable(true)
+		l.Info("SeqTag", 1)
+		l.Info("SeqTag", 2)
+		l.SetEnable(false)
+		l.SetEnable(true)
+		l.Info("SeqTag", 3)
+		l.SetEnable(false)
+
+		want := uint(1)
+		if b {
+			want = 3
+		}
+		if i := s.entries[2].Index; i != want {
+			t.Errorf("seq index is %d after restart, want %d", i, want)
+		}
+	}
+}
+
+func TestSeqIndexWrap(t *testing.T) {
+	l := NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false).SetSyncWriteFile(false)
+	s := &memorySink{}
+	l.AddSink(s)
+
+	t.Log("SetSeqIndexWidth(1)")
+	l.SetSeqIndexWidth(1)
+	l.SetEnable(true)
+	for i := 0; i < 10; i++ {
+		l.Info("SeqTag", i)
+	}
+	l.SetEnable(false)
+
+	for i, want := range []uint{1, 2, 3, 4, 5, 6, 7, 8, 1, 2} {
+		if s.entries[i].Index != want {
+			t.Errorf("seq index of entry %d is %d, want %d", i, s.entries[i].Index, want)
+		}
+	}
+}
+
+func TestWith(t *testing.T) {
+	l := NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false).SetLogTime(false).SetLogCodeFuncName(false).SetLogColor(false)
+	s := &memorySink{}
+	l.AddSink(s)
+
+	t.Log("With() and WithTag()")
+	http := l.WithTag("HTTP").With("req", 7)
+	get := http.WithTag("GET").With("path", "/")
+	l.SetEnable(true)
+	l.Info("Main", "start")
+	http.Info("", "accept")
+	get.InfoW("Cache", "hit", "size", 3)
+	l.Info("Main", "stop")
+	l.SetEnable(false)
+
+	if s.count() != 4 {
+		t.Fatalf("%d entries, want 4", s.count())
+	}
+	want := []string{
+		"[0001] [I][Main]start",
+		"[0002] [I][HTTP]accept req=7",
+		"[0003] [I][HTTP.GET.Cache]hit req=7 path=/ size=3",
+		"[0004] [I][Main]stop",
+	}
+	for i, e := range s.entries {
+		if text := string(l.FormatEntry(LogFormatText, e, false)); text != want[i] {
+			t.Errorf("entry %d is %s, want %s", i, text, want[i])
+		}
+	}
+	if len(http.fields) != 1 {
+		t.Error("fields of parent logger are changed by child")
+	}
+}
+
+// Sink keeps log entries not below level
+type levelSink struct {
+	memorySink
+	level string
+}
+
+func (s *levelSink) GetLevel() string {
+	return s.level
+}
+
+func TestLevel(t *testing.T) {
+	l := NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false)
+	s := &memorySink{}
+	ls := &levelSink{level: ECError}
+	l.AddSink(s).AddSink(ls)
+
+	t.Log("SetLevel(Warn)")
+	l.SetLevel(ECWarn).SetLogError(false)
+	l.SetEnable(true)
+	logAllType(l)
+	l.SetEnable(false)
+
+	if got := strings.Join(s.contents(), "|"); got != "I am a Warn() test|I am a Warn(...) test:Warn something|"+
+		"I am a Panic() test|I am a Panic(...) test:Panic something" {
+		t.Errorf("wrong entries %s", got)
+	}
+	if ls.count() != 2 {
+		t.Errorf("%d entries in sink of level Error, want 2", ls.count())
+	}
+
+	t.Log("SetLevel(Unknown)")
+	if l.SetLevel("Unknown").GetLevel() != ECWarn {
+		t.Error("unknown level is used")
+	}
+}
+
+func TestLevelRules(t *testing.T) {
+	l := NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false)
+	s := &memorySink{}
+	l.AddSink(s)
+
+	t.Log("SetTagLevel(HTTP, Debug)")
+	l.SetLevel(ECWarn).SetTagLevel("HTTP", ECDebug)
+	l.SetEnable(true)
+	l.Debug("HTTP", "1")
+	l.WithTag("HTTP").Debug("GET", "2")
+	l.Trace("HTTP", "no")
+	l.Debug("HTTPS", "no")
+	l.Debugf("DB", "no")
+
+	t.Log("SetPackageLevel(Trace)")
+	l.ClearLevelRules().SetPackageLevel(selfPackage, ECTrace)
+	l.Trace("DB", "3")
+	l.Tracef("DB", "%d", 4)
+	l.TraceW("DB", "5")
+	l.SetPackageLevel("some/other", ECTrace)
+	l.SetPackageLevel(selfPackage, ECError)
+	l.Warn("DB", "no")
+	l.SetEnable(false)
+
+	if got := strings.Join(s.contents(), " "); got != "1 2 3 4 5" {
+		t.Errorf("entries are %s, want 1 2 3 4 5", got)
+	}
+	if len(l.LevelRules) != 2 {
+		t.Errorf("%d level rules, want 2", len(l.LevelRules))
+	}
+
+	t.Log("Package matching")
+	for _, pkg := range []string{"storage", "github.com/a/storage", "github.com/a/storage/sql", "storage/sql"} {
+		if !isPackageMatched(pkg, "storage") {
+			t.Errorf("%s not matched", pkg)
+		}
+	}
+	for _, pkg := range []string{"storages", "github.com/a/mystorage", "github.com/storage2/a"} {
+		if isPackageMatched(pkg, "storage") {
+			t.Errorf("%s matched", pkg)
+		}
+	}
+
+	t.Log("The most specific rule")
+	s = &memorySink{}
+	l = NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false)
+	l.AddSink(s)
+	l.SetLevel(ECWarn).SetTagLevel("HTTP", ECDebug).SetTagLevel("HTTP.GET", ECError).SetPackageLevel(selfPackage, ECTrace)
+	l.SetEnable(true)
+	l.Debug("HTTP", "1")
+	l.Warn("HTTP.GET", "no")
+	l.WithTag("HTTP").Error("GET", "2")
+	l.Trace("DB", "3")
+	l.SetTagLevel("HTTP.GET", "")
+	l.SetTagLevel("HTTP", ECError)
+	l.Trace("HTTP.GET", "4")
+	l.Warn("HTTP", "no")
+	l.SetEnable(false)
+
+	if got := strings.Join(s.contents(), " "); got != "1 2 3 4" {
+		t.Errorf("entries are %s, want 1 2 3 4", got)
+	}
+}
+
+func TestRegisterLevel(t *testing.T) {
+	l := NewCeLogger()
+	l.SetWriteConsole(false).SetWriteFile(false).SetLogTime(false).SetLogCodeFuncName(false).SetLogColor(false)
+	s := &memorySink{}
+	l.AddSink(s)
+
+	t.Log("RegisterLevel(Audit/Notice)")
+	l.RegisterLevel("Audit", 45, &EntryConfig{Tag: "A", IsEnable: true, ForeColor: 35})
+	l.RegisterLevel("Notice", 35, nil)
+	l.SetLevel(ECWarn)
+	l.SetEnable(true)
+	l.Log("Audit", "User", "login")
+	l.Logf("Notice", "User", "%s", "no")
+	l.SetLevel("Notice")
+	l.LogW("Notice", "User", "logout", "user", 12)
+	l.Log("Unknown", "User", "no")
+	l.SetEnable(false)
+
+	if s.count() != 2 {
+		t.Fatalf("%d entries, want 2", s.count())
+	}
+	for i, want := range []string{"[0001] [A][User]login", "[0002] [N][User]logout user=12"} {
+		if text := string(l.FormatEntry(LogFormatText, s.entries[i], false)); text != want {
+			t.Errorf("entry %d is %s, want %s", i, text, want)
+		}
+	}
+
+	t.Log("Save and load custom level")
+	l.SaveConfigFile("TestRegisterLevel.json")
+	c := NewCeLoggerConfig()
+	c.LoadConfigFile("TestRegisterLevel.json")
+	if ec := c.ECMap["Audit"]; ec == nil || ec.Tag != "A" || ec.Severity != 45 {
+		t.Errorf("custom level not loaded %v", ec)
+	}
+
+	t.Log("Tag of non-ASCII name")
+	if ec := l.RegisterLevel("Überwachung", 40, nil); ec == nil || ec.Tag != "Ü" {
+		t.Errorf("wrong default tag %v", ec)
+	}
+}
+
+func TestPanicFatal(t *testing.T) {
+	for _, b := range []bool{true, false} {
+		l := NewCeLogger()
+		l.SetWriteConsole(false).SetWriteFile(false).SetSyncWriteFile(b)
+		s := &memorySink{}
+		l.AddSink(s)
+		code := 0
+		l.SetExitFunc(func(c int) { code = c })
+
+		t.Logf("Panic() with SetSyncWriteFile(%v)", b)
+		l.SetEnable(true)
+		if r := logRecover(func() { l.Panicf("PanicTag", "bad %d", 1) }); r != "bad 1" {
+			t.Errorf("recovered %v, want bad 1", r)
+		}
+		if s.count() != 1 || s.flushed == 0 {
+			t.Error("not flushed before panic")
+		}
+
+		t.Log("Fatal()")
+		l.FatalW("FatalTag", "worse", "code", 2)
+		if code != 1 || s.count() != 2 || s.entries[1].Level != ECFatal {
+			t.Errorf("exit code %d, %d entries", code, s.count())
+		}
+
+		t.Log("Panic() even if not logged")
+		l.SetLogPanic(false)
+		if r := logRecover(func() { l.Panic("PanicTag", "silent") }); r != "silent" {
+			t.Errorf("recovered %v, want silent", r)
+		}
+
+		t.Log("SetPanicLogOnly(true)")
+		l.SetLogPanic(true).SetPanicLogOnly(true)
+		if r := logRecover(func() { l.Panic("PanicTag", "legacy") }); r != nil {
+			t.Errorf("panic %v with IsPanicLogOnly", r)
+		}
+		l.SetEnable(false)
+
+		if s.count() != 3 {
+			t.Errorf("%d entries, want 3", s.count())
+		}
+	}
 }